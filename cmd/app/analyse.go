@@ -0,0 +1,350 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+
+	"github.com/brnck/cni-migration/pkg/analyse"
+	"github.com/brnck/cni-migration/pkg/config"
+)
+
+type ConfigFunc func() (*config.Config, error)
+
+func NewAnalyseCmd(ctx context.Context, newConfig ConfigFunc) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "analyse",
+		Short: "Analyse the AWS VPC CNI setup of the cluster and translate it to Cilium.",
+	}
+
+	cmd.AddCommand(newAnalyseAwsNodeCmd(ctx, newConfig))
+	cmd.AddCommand(newAnalyseENIConfigCmd(ctx, newConfig))
+	cmd.AddCommand(newAnalyseNetworkPolicyCmd(ctx, newConfig))
+	cmd.AddCommand(newAnalyseCapacityCmd(ctx, newConfig))
+
+	return cmd
+}
+
+func newAnalyseAwsNodeCmd(ctx context.Context, newConfig ConfigFunc) *cobra.Command {
+	var output, cniOutput string
+
+	cmd := &cobra.Command{
+		Use:   "aws-node",
+		Short: "Translate the aws-node daemon set settings into suggested Cilium values.",
+		Long: `  Translate the aws-node daemon set environment (WARM_IP_TARGET, MINIMUM_IP_TARGET,
+  ENABLE_PREFIX_DELEGATION, AWS_VPC_K8S_CNI_CUSTOM_NETWORK_CFG, AWS_VPC_K8S_CNI_EXTERNALSNAT, ...)
+  into Cilium ENI values. The suggested values file can be added to cilium.values.
+  Settings that can only be set in the Cilium CNI configuration are written as a
+  ConfigMap, which must be applied before Cilium is deployed.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := newConfig()
+			if err != nil {
+				return err
+			}
+
+			t, err := analyse.New(ctx, config).TranslateAwsNode()
+			if err != nil {
+				return fmt.Errorf("failed to translate aws-node: %s", err)
+			}
+
+			return writeAwsNodeTranslation(cmd.OutOrStdout(), config, t, output, cniOutput)
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "", "File to write the suggested Cilium values to. Defaults to stdout.")
+	cmd.Flags().StringVar(&cniOutput, "cni-config-output", "", "File to write the Cilium CNI configuration ConfigMap to, if one is needed (\"-\" for stdout).")
+
+	return cmd
+}
+
+func newAnalyseENIConfigCmd(ctx context.Context, newConfig ConfigFunc) *cobra.Command {
+	var output, cniOutput, nodeConfigOutput string
+
+	cmd := &cobra.Command{
+		Use:   "eni-config",
+		Short: "Translate VPC CNI custom networking ENIConfigs into Cilium ENI subnets and security groups.",
+		Long: `  Discover the ENIConfigs and the nodes selecting them through the ENI_CONFIG_ANNOTATION_DEF
+  annotation or ENI_CONFIG_LABEL_DEF label, and translate their subnets and security groups
+  into the Cilium CNI configuration, together with the aws-node settings. If subnets or
+  security groups differ in a way the cluster wide configuration cannot express, a CNI
+  configuration is added per node group, with a CiliumNodeConfig selecting it for the nodes
+  labelled with the node group they replace.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := newConfig()
+			if err != nil {
+				return err
+			}
+
+			log := config.Log.WithField("command", "analyse")
+			a := analyse.New(ctx, config)
+
+			t, err := a.TranslateAwsNode()
+			if err != nil {
+				return fmt.Errorf("failed to translate aws-node: %s", err)
+			}
+
+			e, err := a.TranslateENIConfig(t)
+			if err != nil {
+				return err
+			}
+
+			if len(e.ENIConfigs) == 0 {
+				log.Info("no eniconfigs found, custom networking is not used")
+				return nil
+			}
+
+			groups := e.NodeGroups()
+			names := make([]string, 0, len(groups))
+			for name := range groups {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				group := name
+				if group == "" {
+					group = "<none>"
+				}
+				log.Infof("node group %s uses eniconfigs %s", group, strings.Join(groups[name], ", "))
+			}
+
+			for _, u := range e.Unmapped {
+				log.Warn(u)
+			}
+
+			if err := writeAwsNodeTranslation(cmd.OutOrStdout(), config, t, output, cniOutput); err != nil {
+				return err
+			}
+
+			if len(e.NodeGroupConfigs) == 0 {
+				return nil
+			}
+
+			for _, c := range e.NodeGroupConfigs {
+				log.Infof("node group %s uses subnets [%s] and security groups [%s], label its replacement nodes with %s=%s",
+					c.NodeGroup, strings.Join(c.SubnetIDs, ", "), strings.Join(c.SecurityGroups, ", "), analyse.ENINodeGroupLabel, c.NodeGroup)
+			}
+
+			if nodeConfigOutput == "" {
+				log.Warnf("%d node groups need CiliumNodeConfigs, write them with --cilium-node-config-output", len(e.CiliumNodeConfigs))
+				return nil
+			}
+
+			var manifests []byte
+			for _, cn := range e.CiliumNodeConfigs {
+				b, err := yaml.Marshal(cn.Object)
+				if err != nil {
+					return err
+				}
+				manifests = append(manifests, "---\n"...)
+				manifests = append(manifests, b...)
+			}
+
+			log.Infof("writing %d CiliumNodeConfigs to %s", len(e.CiliumNodeConfigs), nodeConfigOutput)
+
+			return writeOutput(cmd.OutOrStdout(), nodeConfigOutput, "", manifests)
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "", "File to write the suggested Cilium values to. Defaults to stdout.")
+	cmd.Flags().StringVar(&cniOutput, "cni-config-output", "", "File to write the Cilium CNI configuration ConfigMap to (\"-\" for stdout).")
+	cmd.Flags().StringVar(&nodeConfigOutput, "cilium-node-config-output", "", "File to write the node group CiliumNodeConfigs to, if any are needed (\"-\" for stdout).")
+
+	return cmd
+}
+
+func newAnalyseNetworkPolicyCmd(ctx context.Context, newConfig ConfigFunc) *cobra.Command {
+	var (
+		output string
+		all    bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "network-policy",
+		Short: "Analyse network policy compatibility and generate CiliumNetworkPolicy equivalents.",
+		Long: `  Detect the network policy engines (the AWS VPC CNI network policy agent or Calico),
+  inventory NetworkPolicies, PolicyEndpoints and Calico policies, and report the
+  constructs Cilium handles differently. CiliumNetworkPolicy equivalents are generated
+  for the NetworkPolicies that need translation, or all of them with --all.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := newConfig()
+			if err != nil {
+				return err
+			}
+
+			log := config.Log.WithField("command", "analyse")
+
+			r, err := analyse.New(ctx, config).NetworkPolicies()
+			if err != nil {
+				return err
+			}
+
+			log.Infof("network policy engines: %s", strings.Join(r.Engines, ", "))
+			log.Infof("found %d NetworkPolicies, %d PolicyEndpoints, %d calico GlobalNetworkPolicies, %d calico NetworkPolicies",
+				len(r.NetworkPolicies), r.PolicyEndpoints, r.CalicoGlobalNetworkPolicies, r.CalicoNetworkPolicies)
+
+			for _, f := range r.Findings {
+				log.Warnf("%s %s/%s: %s", f.Kind, f.Namespace, f.Name, f.Message)
+			}
+
+			policies := r.NeedsTranslation()
+			if all {
+				policies = r.NetworkPolicies
+			}
+
+			if len(policies) == 0 {
+				log.Info("no NetworkPolicies need translation")
+				return nil
+			}
+
+			var manifests []byte
+			for i := range policies {
+				b, err := yaml.Marshal(r.CiliumNetworkPolicy(&policies[i]).Object)
+				if err != nil {
+					return err
+				}
+				manifests = append(manifests, "---\n"...)
+				manifests = append(manifests, b...)
+			}
+
+			return writeOutput(cmd.OutOrStdout(), output, "", manifests)
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "", "File to write the CiliumNetworkPolicies to. Defaults to stdout.")
+	cmd.Flags().BoolVar(&all, "all", false, "Translate all NetworkPolicies, not only those Cilium handles differently.")
+
+	return cmd
+}
+
+func newAnalyseCapacityCmd(ctx context.Context, newConfig ConfigFunc) *cobra.Command {
+	var output string
+
+	cmd := &cobra.Command{
+		Use:   "capacity",
+		Short: "Recommend the Cilium node capacity needed to replace the AWS VPC CNI nodes.",
+		Long: `  Sum the pod requests on the nodes labelled for aws-vpc-cni and the daemon set overhead
+  of Cilium nodes, including the Cilium agent, and recommend the number of Cilium nodes
+  for each node group and instance type. Pods per node are limited by the ENI max pods
+  of the instance type, with the custom networking setting of aws-node and the prefix
+  delegation setting of the Cilium values. The free capacity of the existing Cilium
+  nodes is also reported.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := newConfig()
+			if err != nil {
+				return err
+			}
+
+			log := config.Log.WithField("command", "analyse")
+			a := analyse.New(ctx, config)
+
+			plan, err := a.CapacityPlan()
+			if err != nil {
+				return err
+			}
+
+			for _, w := range plan.Warnings {
+				log.Warn(w)
+			}
+
+			free, err := a.CiliumCapacity(plan)
+			if err != nil {
+				return err
+			}
+			log.Infof("free on cilium nodes: %s", free)
+
+			var buf bytes.Buffer
+			if err := plan.Write(&buf); err != nil {
+				return err
+			}
+
+			return writeOutput(cmd.OutOrStdout(), output, "", buf.Bytes())
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "", "File to write the recommendations to. Defaults to stdout.")
+
+	return cmd
+}
+
+// writeAwsNodeTranslation logs the translated settings and warnings, and
+// writes the suggested values and the CNI configuration ConfigMap.
+func writeAwsNodeTranslation(stdout io.Writer, config *config.Config, t *analyse.AwsNodeTranslation, output, cniOutput string) error {
+	log := config.Log.WithField("command", "analyse")
+
+	for _, s := range t.Settings {
+		log.Infof("%s=%s -> %s", s.Name, s.Value, s.Cilium)
+	}
+	for _, w := range t.Warnings {
+		log.Warn(w)
+	}
+
+	values, err := yaml.Marshal(t.Values)
+	if err != nil {
+		return err
+	}
+
+	header := fmt.Sprintf("# Cilium values translated from %s/%s\n",
+		config.AwsVpcCni.Namespace, config.AwsVpcCni.DaemonsetName)
+	if err := writeOutput(stdout, output, header, values); err != nil {
+		return err
+	}
+
+	cm, err := t.CNIConfigMap(config.Cilium.Namespace)
+	if err != nil {
+		return err
+	}
+	if cm == nil {
+		return nil
+	}
+
+	manifest, err := yaml.Marshal(cm)
+	if err != nil {
+		return err
+	}
+
+	if cniOutput == "" {
+		log.Warnf("the suggested values use the %s/%s cni configuration, which is required before cilium is deployed, write it with --cni-config-output",
+			cm.Namespace, cm.Name)
+		return nil
+	}
+
+	log.Infof("writing cni configuration %s/%s to %s", cm.Namespace, cm.Name, cniOutput)
+
+	return writeOutput(stdout, cniOutput, "", manifest)
+}
+
+// writeOutput writes the header and data to path, or stdout if path is empty
+// or "-".
+func writeOutput(stdout io.Writer, path, header string, data []byte) error {
+	if path == "" || path == "-" {
+		if _, err := io.WriteString(stdout, header); err != nil {
+			return err
+		}
+		_, err := stdout.Write(data)
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := writeOutput(f, "", header, data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
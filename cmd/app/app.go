@@ -3,11 +3,16 @@ package app
 import (
 	"context"
 	"fmt"
+	"github.com/brnck/cni-migration/pkg/decommission"
 	"github.com/brnck/cni-migration/pkg/delete"
 	"github.com/brnck/cni-migration/pkg/deploy"
 	"github.com/brnck/cni-migration/pkg/disable"
 	"github.com/brnck/cni-migration/pkg/enable"
 	"github.com/brnck/cni-migration/pkg/finalize"
+	"github.com/brnck/cni-migration/pkg/hubble"
+	"github.com/brnck/cni-migration/pkg/kubeproxy"
+	"github.com/brnck/cni-migration/pkg/nodecleanup"
+	"github.com/brnck/cni-migration/pkg/nodelabeller"
 	"github.com/brnck/cni-migration/pkg/preflight"
 	"github.com/brnck/cni-migration/pkg/prepare"
 	"github.com/brnck/cni-migration/pkg/priority"
@@ -36,10 +41,14 @@ type Options struct {
 	NoDryRun   bool
 	LogLevel   string
 	ConfigPath string
+	Set        []string
 
 	StepAllPreMigration  bool
 	StepAllPostMigration bool
 
+	// Run between pre-migration and post-migration.
+	StepDecommission bool
+
 	PreMigration struct {
 		//0
 		StepPreflight bool
@@ -72,6 +81,12 @@ type Options struct {
 
 		// 9
 		StepEnable bool
+
+		// 10
+		StepKubeProxy bool
+
+		// 11
+		StepNodeCleanup bool
 	}
 }
 
@@ -91,6 +106,7 @@ const (
 )
 
 var preMigrationSteps []pkg.Step
+var decommissionStep pkg.Step
 var postMigrationSteps []pkg.Step
 
 func NewRunCmd(ctx context.Context) *cobra.Command {
@@ -108,14 +124,9 @@ func NewRunCmd(ctx context.Context) *cobra.Command {
 				return err
 			}
 
-			lvl, err := logrus.ParseLevel(o.LogLevel)
-			if err != nil {
-				return fmt.Errorf("failed to parse --log-level: %s", err)
-			}
-
-			config, err := config.New(o.ConfigPath, lvl, factory)
+			config, err := o.newConfig(factory)
 			if err != nil {
-				return fmt.Errorf("failed to build config: %s", err)
+				return err
 			}
 
 			for _, f := range []NewFunc{
@@ -125,17 +136,31 @@ func NewRunCmd(ctx context.Context) *cobra.Command {
 				priority.New,
 				deploy.New,
 			} {
-				preMigrationSteps = append(preMigrationSteps, f(ctx, config))
+				preMigrationSteps = append(preMigrationSteps, newStep(ctx, config, f))
 			}
 
+			decommissionStep = newStep(ctx, config, decommission.New)
+
 			for _, f := range []NewFunc{
 				delete.New,
 				remove.New,
 				update.New,
 				finalize.New,
 				enable.New,
+				kubeproxy.New,
+				nodecleanup.New,
 			} {
-				postMigrationSteps = append(postMigrationSteps, f(ctx, config))
+				postMigrationSteps = append(postMigrationSteps, newStep(ctx, config, f))
+			}
+
+			if config.NodeLabeller.Enabled {
+				// Every node must have one migration label from after step 2
+				// until aws-node is deleted in step 5.
+				for i := 3; i < len(preMigrationSteps); i++ {
+					preMigrationSteps[i] = nodelabeller.Watch(ctx, config, preMigrationSteps[i])
+				}
+				decommissionStep = nodelabeller.Watch(ctx, config, decommissionStep)
+				postMigrationSteps[0] = nodelabeller.Watch(ctx, config, postMigrationSteps[0])
 			}
 
 			if err := run(config, o); err != nil {
@@ -149,31 +174,78 @@ func NewRunCmd(ctx context.Context) *cobra.Command {
 
 	nfs := new(cliflag.NamedFlagSets)
 
+	// Sub commands use the default help and usage, listing the global flags
+	// they inherit.
+	defaultUsage, defaultHelp := cmd.UsageFunc(), cmd.HelpFunc()
+
 	// pretty output from kube-apiserver
 	usageFmt := "Usage:\n  %s\n\n"
 	cmd.SetUsageFunc(func(cmd *cobra.Command) error {
+		if cmd.HasParent() {
+			return defaultUsage(cmd)
+		}
 		fmt.Fprintf(cmd.OutOrStderr(), usageFmt, cmd.UseLine())
 		cliflag.PrintSections(cmd.OutOrStderr(), *nfs, -1)
 		return nil
 	})
 
 	cmd.SetHelpFunc(func(cmd *cobra.Command, args []string) {
+		if cmd.HasParent() {
+			defaultHelp(cmd, args)
+			return
+		}
 		fmt.Fprintf(cmd.OutOrStdout(), "%s\n\n"+usageFmt, cmd.Long, cmd.UseLine())
 		fmt.Fprintf(cmd.OutOrStdout(), "Examples:%s\n", cmd.Example)
 		cliflag.PrintSections(cmd.OutOrStdout(), *nfs, -1)
 	})
 
 	o.AddFlags(nfs.FlagSet("Option"))
+	o.AddGlobalFlags(nfs.FlagSet("Global"))
 	factory = AddKubeFlags(cmd, nfs.FlagSet("Client"))
 
-	fs := cmd.Flags()
-	for _, f := range nfs.FlagSets {
-		fs.AddFlagSet(f)
+	cmd.Flags().AddFlagSet(nfs.FlagSet("Option"))
+	for _, name := range []string{"Global", "Client"} {
+		cmd.PersistentFlags().AddFlagSet(nfs.FlagSet(name))
+	}
+
+	newConfig := func() (*config.Config, error) {
+		return o.newConfig(factory)
 	}
 
+	cmd.AddCommand(NewAnalyseCmd(ctx, newConfig))
+	cmd.AddCommand(NewScanCmd(ctx, newConfig))
+	cmd.AddCommand(NewRestoreAwsNodeCmd(ctx, newConfig))
+	cmd.AddCommand(NewLabelNodesCmd(ctx, newConfig))
+
 	return cmd
 }
 
+// newStep builds a step, observing dropped flows while it runs if Hubble is
+// enabled.
+func newStep(ctx context.Context, config *config.Config, f NewFunc) pkg.Step {
+	step := f(ctx, config)
+	if config.Hubble.Enabled {
+		step = hubble.Observe(ctx, config, step)
+	}
+	return step
+}
+
+// newConfig builds the config from the global flags.
+func (o *Options) newConfig(factory cmdutil.Factory) (*config.Config, error) {
+	lvl, err := logrus.ParseLevel(o.LogLevel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse --log-level: %s", err)
+	}
+
+	config, err := config.New(o.ConfigPath, lvl, factory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build config: %s", err)
+	}
+	config.Cilium.SetOverrides = o.Set
+
+	return config, nil
+}
+
 func run(config *config.Config, o *Options) error {
 	dryrun := !o.NoDryRun
 
@@ -185,6 +257,24 @@ func run(config *config.Config, o *Options) error {
 		return runAllSteps(preMigrationSteps, dryrun)
 	}
 
+	if o.StepDecommission {
+		last := len(preMigrationSteps) - 1
+		if err := ensureStepReady(last, preMigrationSteps[last]); err != nil {
+			return err
+		}
+
+		return decommissionStep.Run(dryrun)
+	}
+
+	postMigration := o.StepAllPostMigration || resolveMaxStep(reflect.ValueOf(o.PostMigration)) != -1
+	if postMigration {
+		// Post-migration is only allowed once the aws-vpc-cni nodes are
+		// decommissioned.
+		if err := ensureDecommissionReady(); err != nil {
+			return err
+		}
+	}
+
 	if o.StepAllPostMigration {
 		return runAllSteps(postMigrationSteps, dryrun)
 	}
@@ -263,6 +353,19 @@ func runSteps(steps []pkg.Step, maxStep int, flags reflect.Value, dryrun bool) e
 	return nil
 }
 
+func ensureDecommissionReady() error {
+	ready, err := decommissionStep.Ready()
+	if err != nil {
+		return fmt.Errorf("decommission step failed: %s", err)
+	}
+
+	if !ready {
+		return fmt.Errorf("decommission step not ready, run --step-decommission before post-migration")
+	}
+
+	return nil
+}
+
 func ensureStepReady(i int, step pkg.Step) error {
 	ready, err := step.Ready()
 	if err != nil {
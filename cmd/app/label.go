@@ -0,0 +1,40 @@
+package app
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+
+	"github.com/brnck/cni-migration/pkg/nodelabeller"
+)
+
+func NewLabelNodesCmd(ctx context.Context, newConfig ConfigFunc) *cobra.Command {
+	var noDryRun bool
+
+	cmd := &cobra.Command{
+		Use:   "label-nodes",
+		Short: "Label nodes joining during the migration until interrupted.",
+		Long: `  Watch nodes, and label nodes which join with neither the aws-vpc-cni nor the
+  cilium label by the nodeLabeller rules of their node group. Nodes matching no
+  rule are logged and a warning event is recorded on them. Run it between step 2
+  and step 5, and stop it before step 6 removes the labels.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := newConfig()
+			if err != nil {
+				return err
+			}
+
+			log := config.Log.WithField("command", "label-nodes")
+			if !noDryRun {
+				log.Info("running in dry run mode, use --no-dry-run to label nodes")
+			}
+
+			return nodelabeller.New(ctx, log, config, !noDryRun).Run()
+		},
+	}
+
+	cmd.Flags().BoolVar(&noDryRun, "no-dry-run", false, "Label nodes, instead of only logging the labels to apply.")
+
+	return cmd
+}
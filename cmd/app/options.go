@@ -26,12 +26,21 @@ func (o *Options) AddFlags(fs *pflag.FlagSet) {
 	fs.BoolVarP(&o.PreMigration.StepPriority, "step-priority", "3", false, "[3] - [pre-migration] Set node selector on AWS VPC CNI daemon set.")
 	fs.BoolVarP(&o.PreMigration.StepDeploy, "step-deploy", "4", false, "[4] - [pre-migration] Deploy Cilium helm chart to the cluster")
 
+	fs.BoolVar(&o.StepDecommission, "step-decommission", false, "[decommission] - Cordon and drain AWS VPC CNI nodes, and scale down their node groups if configured. Required before post-migration")
+
 	fs.BoolVarP(&o.PostMigration.StepDelete, "step-delete", "5", false, "[5] - [post-migration] Remove AWS VPC CNI daemon set from the cluster")
 	fs.BoolVarP(&o.PostMigration.StepRemove, "step-remove", "6", false, "[6] - [post-migration] Remove AWS VPC CNI node role label from the nodes")
 	fs.BoolVarP(&o.PostMigration.StepUpdate, "step-update", "7", false, "[7] - [post-migration] Upgrade Cilium by removing node selector")
 	fs.BoolVarP(&o.PostMigration.StepUpdate, "step-finalize", "8", false, "[8] - [post-migration] Remove Cilium node role label from the nodes")
 	fs.BoolVarP(&o.PostMigration.StepEnable, "step-enable", "9", false, "[9] - [post-migration] Upscale cluster autoscaler back to configured replicas")
+	fs.BoolVar(&o.PostMigration.StepKubeProxy, "step-kube-proxy", false, "[10] - [post-migration] Replace kube-proxy with Cilium, if kubeProxyReplacement is enabled")
+	fs.BoolVar(&o.PostMigration.StepNodeCleanup, "step-node-cleanup", false, "[11] - [post-migration] Remove aws-node CNI configuration, iptables chains and IPAM state from nodes, if nodeCleanup is enabled")
+
+	fs.StringArrayVar(&o.Set, "set", nil, "Set Cilium helm values for the phase being run, overriding the values files and config (can be repeated, e.g. --set hubble.ui.enabled=false).")
+}
 
+// AddGlobalFlags adds the flags shared by all commands.
+func (o *Options) AddGlobalFlags(fs *pflag.FlagSet) {
 	fs.StringVarP(&o.LogLevel, "log-level", "v", "debug", "Set logging level [debug|info|warn|error|fatal]")
 	fs.StringVarP(&o.ConfigPath, "config", "c", "config.yaml", "File path to the config path.")
 }
@@ -87,5 +96,9 @@ func (o *Options) Validate() error {
 		return err
 	}
 
+	if o.StepDecommission && (o.StepAllPreMigration || o.StepAllPostMigration || preMigrationStepsActivated || postMigrationStepsActivated) {
+		return errors.New("the decommission step must be run on its own, between pre-migration and post-migration")
+	}
+
 	return nil
 }
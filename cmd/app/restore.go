@@ -0,0 +1,49 @@
+package app
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+
+	"github.com/brnck/cni-migration/pkg/util"
+)
+
+func NewRestoreAwsNodeCmd(ctx context.Context, newConfig ConfigFunc) *cobra.Command {
+	var (
+		file     string
+		noDryRun bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "restore-aws-node",
+		Short: "Restore aws-node from the backup taken before it was deleted.",
+		Long: `  Re-create the aws-node daemon set, its config map, service account and cluster
+  roles with their original spec, from the backup file or the backup secret taken
+  by the delete step. Objects which still exist are left unchanged.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := newConfig()
+			if err != nil {
+				return err
+			}
+
+			log := config.Log.WithField("command", "restore-aws-node")
+			if !noDryRun {
+				log.Info("running in dry run mode, use --no-dry-run to restore aws-node")
+			}
+
+			if err := util.New(ctx, log, config).RestoreAwsNode(file, !noDryRun); err != nil {
+				return err
+			}
+
+			log.Warn("the restored aws-node daemon set keeps the node selector of the priority step, and only runs on nodes labelled for aws-node")
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&file, "file", "", "Backup file to restore from. Defaults to the backup secret in the cluster.")
+	cmd.Flags().BoolVar(&noDryRun, "no-dry-run", false, "Restore aws-node, instead of only logging the objects to restore.")
+
+	return cmd
+}
@@ -0,0 +1,59 @@
+package app
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/spf13/cobra"
+
+	"github.com/brnck/cni-migration/pkg/analyse"
+)
+
+func NewScanCmd(ctx context.Context, newConfig ConfigFunc) *cobra.Command {
+	var (
+		format string
+		output string
+		all    bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "scan",
+		Short: "Scan workloads for compatibility risks with the CNI migration.",
+		Long: `  Walk all pods and controllers and classify the risk of each workload being affected
+  by the migration, with the reasons: host port users, host network pods, pods with
+  static IPs or addressed by IP, and pods using branch ENIs or eniConfig annotations.
+  Review the report before starting the pre-migration.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Fail before scanning the cluster.
+			if err := analyse.ValidateFormat(format); err != nil {
+				return err
+			}
+
+			config, err := newConfig()
+			if err != nil {
+				return err
+			}
+
+			r, err := analyse.New(ctx, config).Scan(all)
+			if err != nil {
+				return err
+			}
+
+			config.Log.WithField("command", "scan").Infof("found %d workloads at risk", r.AtRisk())
+
+			var buf bytes.Buffer
+			if err := r.Write(&buf, format); err != nil {
+				return err
+			}
+
+			return writeOutput(cmd.OutOrStdout(), output, "", buf.Bytes())
+		},
+	}
+
+	cmd.Flags().StringVarP(&format, "format", "f", analyse.FormatTable, "Report format [table|json|markdown].")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "File to write the report to. Defaults to stdout.")
+	cmd.Flags().BoolVar(&all, "all", false, "Include workloads without any risk.")
+
+	return cmd
+}
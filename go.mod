@@ -1,19 +1,24 @@
 module github.com/brnck/cni-migration
 
-go 1.14
+go 1.16
 
 require (
+	github.com/aws/aws-sdk-go v1.44.200
 	github.com/go-gorp/gorp/v3 v3.1.0 // indirect
 	github.com/mittwald/go-helm-client v0.11.5
 	github.com/sirupsen/logrus v1.9.0
 	github.com/spf13/cobra v1.6.1
 	github.com/spf13/pflag v1.0.5
+	google.golang.org/grpc v1.49.0
+	google.golang.org/protobuf v1.28.1
 	gopkg.in/yaml.v2 v2.4.0
 	helm.sh/helm/v3 v3.11.1
+	k8s.io/api v0.26.2
 	k8s.io/apimachinery v0.26.2
 	k8s.io/cli-runtime v0.26.2
 	k8s.io/client-go v0.26.2
 	k8s.io/component-base v0.26.2
 	k8s.io/klog v1.0.0
 	k8s.io/kubectl v0.26.2
+	sigs.k8s.io/yaml v1.3.0
 )
@@ -0,0 +1,32 @@
+package analyse
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/brnck/cni-migration/pkg/config"
+)
+
+// Analyser inspects the cluster's AWS VPC CNI setup and reports how it
+// translates to Cilium.
+type Analyser struct {
+	ctx    context.Context
+	config *config.Config
+
+	log           *logrus.Entry
+	client        *kubernetes.Clientset
+	dynamicClient dynamic.Interface
+}
+
+func New(ctx context.Context, config *config.Config) *Analyser {
+	return &Analyser{
+		ctx:           ctx,
+		config:        config,
+		log:           config.Log.WithField("command", "analyse"),
+		client:        config.Client,
+		dynamicClient: config.DynamicClient,
+	}
+}
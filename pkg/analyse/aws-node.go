@@ -0,0 +1,351 @@
+package analyse
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	awsNodeContainer = "aws-node"
+
+	// CNIConfigMapName is the ConfigMap holding the Cilium CNI configuration
+	// when cni.customConf is enabled.
+	CNIConfigMapName = "cni-configuration"
+	// CNIConfigMapKey is the Cilium chart default cni.configMapKey.
+	CNIConfigMapKey = "cni-config"
+)
+
+// awsNodeDefaults are the aws-node defaults of settings that only need
+// translating when changed.
+var awsNodeDefaults = map[string]string{
+	"WARM_ENI_TARGET":                       "1",
+	"WARM_PREFIX_TARGET":                    "1",
+	"ENABLE_POD_ENI":                        "false",
+	"ENABLE_IPv4":                           "true",
+	"ENABLE_IPv6":                           "false",
+	"ENABLE_PREFIX_DELEGATION":              "false",
+	"AWS_VPC_K8S_CNI_CUSTOM_NETWORK_CFG":    "false",
+	"AWS_VPC_K8S_CNI_EXTERNALSNAT":          "false",
+	"AWS_VPC_ENI_MTU":                       "9001",
+	"AWS_VPC_K8S_CNI_RANDOMIZESNAT":         "prng",
+	"POD_SECURITY_GROUP_ENFORCING_MODE":     "strict",
+	"DISABLE_TCP_EARLY_DEMUX":               "false",
+	"AWS_VPC_K8S_CNI_CONFIGURE_RPFILTER":    "false",
+	"DISABLE_INTROSPECTION":                 "false",
+	"DISABLE_METRICS":                       "false",
+	"DISABLE_NETWORK_RESOURCE_PROVISIONING": "false",
+}
+
+// awsNodeIgnored are aws-node settings which have no effect on pod networking,
+// or which are translated by other analysers.
+var awsNodeIgnored = map[string]bool{
+	"AWS_VPC_K8S_CNI_LOGLEVEL":     true,
+	"AWS_VPC_K8S_CNI_LOG_FILE":     true,
+	"AWS_VPC_K8S_PLUGIN_LOG_FILE":  true,
+	"AWS_VPC_K8S_PLUGIN_LOG_LEVEL": true,
+	"AWS_VPC_K8S_CNI_VETHPREFIX":   true,
+	"MY_NODE_NAME":                 true,
+	"MY_POD_NAME":                  true,
+	"CLUSTER_NAME":                 true,
+	"VPC_ID":                       true,
+	"VPC_CNI_VERSION":              true,
+	"ENI_CONFIG_LABEL_DEF":         true,
+	"ENI_CONFIG_ANNOTATION_DEF":    true,
+}
+
+// Setting is an aws-node setting and the Cilium configuration it translates
+// to.
+type Setting struct {
+	Name   string
+	Value  string
+	Cilium string
+}
+
+// AwsNodeTranslation is the aws-node configuration translated into Cilium
+// values.
+type AwsNodeTranslation struct {
+	// Env is the aws-node container environment.
+	Env map[string]string
+
+	Settings []Setting
+	Warnings []string
+
+	// Values are the suggested Cilium helm values.
+	Values map[string]interface{}
+
+	// CNIConfig is the Cilium CNI configuration for settings which can only
+	// be set through it, or nil if none are needed.
+	CNIConfig map[string]interface{}
+
+	// NodeGroupCNIConfigs are CNI configurations for the nodes of single
+	// node groups, by their key in the CNI ConfigMap.
+	NodeGroupCNIConfigs map[string]map[string]interface{}
+}
+
+// TranslateAwsNode inspects the aws-node DaemonSet and translates its
+// settings into the equivalent Cilium ENI values, with warnings for settings
+// that have no equivalent.
+func (a *Analyser) TranslateAwsNode() (*AwsNodeTranslation, error) {
+	ds, err := a.client.AppsV1().
+		DaemonSets(a.config.AwsVpcCni.Namespace).
+		Get(a.ctx, a.config.AwsVpcCni.DaemonsetName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	t := &AwsNodeTranslation{
+		Env:    make(map[string]string),
+		Values: make(map[string]interface{}),
+	}
+
+	container := awsNodeContainerSpec(ds.Spec.Template.Spec.Containers)
+	if container == nil {
+		return nil, fmt.Errorf("daemonset %s/%s has no containers", ds.Namespace, ds.Name)
+	}
+
+	for _, env := range container.Env {
+		if env.ValueFrom != nil {
+			if !awsNodeIgnored[env.Name] {
+				t.warnf("%s is set from a reference, unable to translate", env.Name)
+			}
+			continue
+		}
+		t.Env[env.Name] = env.Value
+	}
+
+	names := make([]string, 0, len(t.Env))
+	for name := range t.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := t.translate(name, t.Env[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	t.setCNIValues()
+
+	return t, nil
+}
+
+func (t *AwsNodeTranslation) translate(name, value string) error {
+	if awsNodeIgnored[name] {
+		return nil
+	}
+
+	if def, ok := awsNodeDefaults[name]; ok && def == value {
+		return nil
+	}
+
+	switch name {
+	case "WARM_IP_TARGET":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s=%q: %s", name, value, err)
+		}
+		t.setCNI("ipam", "pre-allocate", n)
+		t.setting(name, value, fmt.Sprintf("CNI ipam.pre-allocate: %d", n))
+
+	case "MINIMUM_IP_TARGET":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s=%q: %s", name, value, err)
+		}
+		t.setCNI("ipam", "min-allocate", n)
+		t.setting(name, value, fmt.Sprintf("CNI ipam.min-allocate: %d", n))
+
+	case "ENABLE_PREFIX_DELEGATION":
+		enabled := value == "true"
+		t.setValue("eni", "awsEnablePrefixDelegation", enabled)
+		t.setting(name, value, fmt.Sprintf("eni.awsEnablePrefixDelegation: %t", enabled))
+
+	case "AWS_VPC_K8S_CNI_CUSTOM_NETWORK_CFG":
+		if value != "true" {
+			return nil
+		}
+		t.setCNI("eni", "first-interface-index", 1)
+		t.setting(name, value, "CNI eni.first-interface-index: 1")
+		t.warnf("%s is enabled, pod subnets and security groups from ENIConfigs are translated by `analyse eni-config`", name)
+
+	case "AWS_VPC_K8S_CNI_EXTERNALSNAT":
+		external := value == "true"
+		t.Values["enableIPv4Masquerade"] = !external
+		t.setting(name, value, fmt.Sprintf("enableIPv4Masquerade: %t", !external))
+
+	case "AWS_VPC_ENI_MTU":
+		mtu, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s=%q: %s", name, value, err)
+		}
+		t.Values["MTU"] = mtu
+		t.setting(name, value, fmt.Sprintf("MTU: %d", mtu))
+
+	case "ADDITIONAL_ENI_TAGS":
+		tags := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(value), &tags); err != nil {
+			return fmt.Errorf("failed to parse %s=%q: %s", name, value, err)
+		}
+		t.setCNI("eni", "eni-tags", tags)
+		t.setting(name, value, "CNI eni.eni-tags")
+
+	case "WARM_ENI_TARGET", "WARM_PREFIX_TARGET", "MAX_ENI":
+		t.warnf("%s=%s has no Cilium equivalent, use WARM_IP_TARGET/MINIMUM_IP_TARGET (CNI ipam.pre-allocate/min-allocate) instead", name, value)
+
+	case "AWS_VPC_K8S_CNI_EXCLUDE_SNAT_CIDRS":
+		t.warnf("%s=%s has no direct equivalent, configure the non masquerade CIDRs through Cilium's ip-masq-agent", name, value)
+
+	case "ENABLE_POD_ENI", "POD_SECURITY_GROUP_ENFORCING_MODE":
+		t.warnf("%s=%s: security groups for pods are not supported by Cilium", name, value)
+
+	case "ENABLE_IPv4", "ENABLE_IPv6":
+		t.warnf("%s=%s: only IPv4 is supported by Cilium ENI mode", name, value)
+
+	default:
+		t.warnf("%s=%s has no Cilium equivalent", name, value)
+	}
+
+	return nil
+}
+
+func (t *AwsNodeTranslation) setting(name, value, cilium string) {
+	t.Settings = append(t.Settings, Setting{Name: name, Value: value, Cilium: cilium})
+}
+
+func (t *AwsNodeTranslation) warnf(format string, args ...interface{}) {
+	t.Warnings = append(t.Warnings, fmt.Sprintf(format, args...))
+}
+
+// setValue sets a nested helm value.
+func (t *AwsNodeTranslation) setValue(table, key string, value interface{}) {
+	setNested(t.Values, table, key, value)
+}
+
+// setCNI sets a key in a section of the Cilium CNI plugin configuration.
+func (t *AwsNodeTranslation) setCNI(section, key string, value interface{}) {
+	if t.CNIConfig == nil {
+		t.CNIConfig = map[string]interface{}{
+			"cniVersion": "0.3.1",
+			"name":       "cilium",
+			"plugins": []interface{}{
+				map[string]interface{}{
+					"cniVersion": "0.3.1",
+					"type":       "cilium-cni",
+				},
+			},
+		}
+	}
+
+	plugin := t.CNIConfig["plugins"].([]interface{})[0].(map[string]interface{})
+	setNested(plugin, section, key, value)
+}
+
+// setCNIValues makes the Cilium chart read the CNI configuration from the
+// CNI ConfigMap, if one is needed.
+func (t *AwsNodeTranslation) setCNIValues() {
+	if t.CNIConfig == nil {
+		return
+	}
+
+	t.Values["cni"] = map[string]interface{}{
+		"customConf":   true,
+		"configMap":    CNIConfigMapName,
+		"configMapKey": CNIConfigMapKey,
+	}
+}
+
+// setNodeGroupCNI adds a CNI configuration under key, which is the cluster
+// wide configuration with the eni section keys replaced by eni.
+func (t *AwsNodeTranslation) setNodeGroupCNI(key string, eni map[string]interface{}) error {
+	// Custom networking always places pods on secondary ENIs.
+	t.setCNI("eni", "first-interface-index", 1)
+
+	// Copy the cluster wide configuration, so it is not changed.
+	b, err := json.Marshal(t.CNIConfig)
+	if err != nil {
+		return err
+	}
+
+	var config map[string]interface{}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return err
+	}
+
+	plugin := config["plugins"].([]interface{})[0].(map[string]interface{})
+	for k, v := range eni {
+		setNested(plugin, "eni", k, v)
+	}
+
+	if t.NodeGroupCNIConfigs == nil {
+		t.NodeGroupCNIConfigs = make(map[string]map[string]interface{})
+	}
+	t.NodeGroupCNIConfigs[key] = config
+
+	return nil
+}
+
+// CNIConfigMap returns the ConfigMap holding the Cilium CNI configuration in
+// namespace, or nil if no CNI configuration is needed.
+func (t *AwsNodeTranslation) CNIConfigMap(namespace string) (*corev1.ConfigMap, error) {
+	if t.CNIConfig == nil {
+		return nil, nil
+	}
+
+	b, err := json.MarshalIndent(t.CNIConfig, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]string{
+		CNIConfigMapKey: string(b),
+	}
+
+	for key, config := range t.NodeGroupCNIConfigs {
+		b, err := json.MarshalIndent(config, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		data[key] = string(b)
+	}
+
+	return &corev1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      CNIConfigMapName,
+			Namespace: namespace,
+		},
+		Data: data,
+	}, nil
+}
+
+func awsNodeContainerSpec(containers []corev1.Container) *corev1.Container {
+	for i := range containers {
+		if containers[i].Name == awsNodeContainer {
+			return &containers[i]
+		}
+	}
+
+	if len(containers) > 0 {
+		return &containers[0]
+	}
+
+	return nil
+}
+
+func setNested(m map[string]interface{}, table, key string, value interface{}) {
+	t, ok := m[table].(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+		m[table] = t
+	}
+	t[key] = value
+}
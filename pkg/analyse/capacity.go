@@ -0,0 +1,361 @@
+package analyse
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const instanceTypeLabel = "node.kubernetes.io/instance-type"
+
+// Capacity is an amount of CPU, memory and pods.
+type Capacity struct {
+	MilliCPU int64
+	Memory   int64
+	Pods     int
+}
+
+func (c *Capacity) add(o Capacity) {
+	c.MilliCPU += o.MilliCPU
+	c.Memory += o.Memory
+	c.Pods += o.Pods
+}
+
+func (c *Capacity) sub(o Capacity) {
+	c.MilliCPU -= o.MilliCPU
+	c.Memory -= o.Memory
+	c.Pods -= o.Pods
+}
+
+func (c Capacity) String() string {
+	return fmt.Sprintf("cpu %dm, memory %dMi, pods %d", c.MilliCPU, c.Memory>>20, c.Pods)
+}
+
+// NodeGroupPlan is the Cilium capacity needed to replace the AWS VPC CNI
+// nodes of a node group and instance type.
+type NodeGroupPlan struct {
+	NodeGroup    string
+	InstanceType string
+	// Nodes is the number of AWS VPC CNI nodes.
+	Nodes int
+	// Workloads are the requests of the pods to move to Cilium nodes.
+	Workloads Capacity
+	// NodeCapacity is the capacity of a Cilium node left for workloads, after
+	// the daemon set overhead. Pods are limited by the ENI max pods.
+	NodeCapacity Capacity
+	// RecommendedNodes is the number of Cilium nodes needed.
+	RecommendedNodes int
+	// LimitedBy is the resource which decides the recommended nodes.
+	LimitedBy string
+}
+
+// CapacityPlan is the Cilium capacity needed to replace the AWS VPC CNI
+// nodes.
+type CapacityPlan struct {
+	// DaemonSetOverhead is the requests of the daemon sets on every Cilium
+	// node, including the Cilium agent.
+	DaemonSetOverhead Capacity
+	// Workloads are the requests of all pods on AWS VPC CNI nodes, except
+	// daemon set pods.
+	Workloads  Capacity
+	NodeGroups []*NodeGroupPlan
+	Warnings   []string
+
+	eni ENISettings
+}
+
+// CapacityPlan sums the requests of the workloads on AWS VPC CNI nodes and the
+// daemon set overhead of Cilium nodes, and recommends the number of Cilium
+// nodes for each node group and instance type, with pods limited by the ENI
+// max pods of the instance type.
+func (a *Analyser) CapacityPlan() (*CapacityPlan, error) {
+	p := new(CapacityPlan)
+
+	settings, found, err := a.ENISettings()
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		p.warnf("aws-node not found, assuming pods use the primary ENI")
+	}
+	p.eni = settings
+
+	if p.DaemonSetOverhead, err = a.daemonSetOverhead(p); err != nil {
+		return nil, err
+	}
+
+	nodes, err := a.client.CoreV1().Nodes().List(a.ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", a.config.Labels.AwsVpcCni, a.config.Labels.Value),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]*NodeGroupPlan)
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+
+		group, instanceType := node.Labels[nodeGroupLabel], node.Labels[instanceTypeLabel]
+		key := group + "/" + instanceType
+
+		g, ok := groups[key]
+		if !ok {
+			g = &NodeGroupPlan{
+				NodeGroup:    group,
+				InstanceType: instanceType,
+				NodeCapacity: p.nodeCapacity(node),
+			}
+			g.NodeCapacity.sub(p.DaemonSetOverhead)
+			groups[key] = g
+		}
+		g.Nodes++
+
+		pods, err := a.nodePods(node.Name)
+		if err != nil {
+			return nil, err
+		}
+		for j := range pods {
+			if ownerKind(&pods[j]) == "DaemonSet" {
+				continue
+			}
+			requests := podRequests(&pods[j])
+			g.Workloads.add(requests)
+			p.Workloads.add(requests)
+		}
+	}
+
+	for _, g := range groups {
+		p.recommend(g)
+		p.NodeGroups = append(p.NodeGroups, g)
+	}
+
+	sort.Slice(p.NodeGroups, func(i, j int) bool {
+		gi, gj := p.NodeGroups[i], p.NodeGroups[j]
+		if gi.NodeGroup != gj.NodeGroup {
+			return gi.NodeGroup < gj.NodeGroup
+		}
+		return gi.InstanceType < gj.InstanceType
+	})
+
+	return p, nil
+}
+
+// CiliumCapacity returns the capacity left on the schedulable Cilium labelled
+// nodes, with pods limited by the ENI max pods of their instance type.
+func (a *Analyser) CiliumCapacity(p *CapacityPlan) (Capacity, error) {
+	var free Capacity
+
+	nodes, err := a.client.CoreV1().Nodes().List(a.ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", a.config.Labels.Cilium, a.config.Labels.Value),
+	})
+	if err != nil {
+		return free, err
+	}
+
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if node.Spec.Unschedulable {
+			continue
+		}
+
+		c := p.nodeCapacity(node)
+
+		pods, err := a.nodePods(node.Name)
+		if err != nil {
+			return free, err
+		}
+		for j := range pods {
+			c.sub(podRequests(&pods[j]))
+		}
+
+		if c.MilliCPU < 0 {
+			c.MilliCPU = 0
+		}
+		if c.Memory < 0 {
+			c.Memory = 0
+		}
+		if c.Pods < 0 {
+			c.Pods = 0
+		}
+
+		free.add(c)
+	}
+
+	return free, nil
+}
+
+// daemonSetOverhead returns the requests of the daemon sets which run on
+// Cilium nodes. aws-node, and daemon sets selecting AWS VPC CNI nodes, are
+// not included.
+func (a *Analyser) daemonSetOverhead(p *CapacityPlan) (Capacity, error) {
+	var overhead Capacity
+
+	daemonsets, err := a.client.AppsV1().DaemonSets(metav1.NamespaceAll).List(a.ctx, metav1.ListOptions{})
+	if err != nil {
+		return overhead, err
+	}
+
+	cilium := false
+	for i := range daemonsets.Items {
+		ds := &daemonsets.Items[i]
+
+		if ds.Namespace == a.config.AwsVpcCni.Namespace && ds.Name == a.config.AwsVpcCni.DaemonsetName {
+			continue
+		}
+		if _, ok := ds.Spec.Template.Spec.NodeSelector[a.config.Labels.AwsVpcCni]; ok {
+			continue
+		}
+		if ds.Namespace == a.config.Cilium.Namespace && ds.Name == a.config.Cilium.ReleaseName {
+			cilium = true
+		}
+
+		overhead.add(specRequests(&ds.Spec.Template.Spec))
+	}
+
+	if !cilium {
+		p.warnf("cilium daemon set %s/%s not found, the cilium agent overhead is not included",
+			a.config.Cilium.Namespace, a.config.Cilium.ReleaseName)
+	}
+
+	return overhead, nil
+}
+
+// nodeCapacity returns the allocatable capacity of a node, with pods also
+// limited by the ENI max pods of its instance type.
+func (p *CapacityPlan) nodeCapacity(node *corev1.Node) Capacity {
+	c := Capacity{
+		MilliCPU: node.Status.Allocatable.Cpu().MilliValue(),
+		Memory:   node.Status.Allocatable.Memory().Value(),
+		Pods:     int(node.Status.Allocatable.Pods().Value()),
+	}
+
+	instanceType := node.Labels[instanceTypeLabel]
+	limit, ok := InstanceENILimit(instanceType)
+	if !ok {
+		p.warnf("instance type %q of node %s has no known ENI limits, using its allocatable pods", instanceType, node.Name)
+		return c
+	}
+
+	if pods := limit.MaxPods(p.eni.FirstInterfaceIndex, p.eni.PrefixDelegation); pods < c.Pods {
+		c.Pods = pods
+	}
+
+	return c
+}
+
+// recommend sets the number of Cilium nodes needed for the workloads of a
+// node group.
+func (p *CapacityPlan) recommend(g *NodeGroupPlan) {
+	for _, r := range []struct {
+		name          string
+		need, perNode int64
+	}{
+		{"cpu", g.Workloads.MilliCPU, g.NodeCapacity.MilliCPU},
+		{"memory", g.Workloads.Memory, g.NodeCapacity.Memory},
+		{"pods", int64(g.Workloads.Pods), int64(g.NodeCapacity.Pods)},
+	} {
+		if r.need == 0 {
+			continue
+		}
+		if r.perNode <= 0 {
+			p.warnf("node group %s %s has no %s left for workloads after the daemon set overhead",
+				g.NodeGroup, g.InstanceType, r.name)
+			continue
+		}
+
+		if nodes := int((r.need + r.perNode - 1) / r.perNode); nodes > g.RecommendedNodes {
+			g.RecommendedNodes = nodes
+			g.LimitedBy = r.name
+		}
+	}
+}
+
+func (p *CapacityPlan) warnf(format string, args ...interface{}) {
+	w := fmt.Sprintf(format, args...)
+	if !hasString(p.Warnings, w) {
+		p.Warnings = append(p.Warnings, w)
+	}
+}
+
+// Write writes the plan to w as a table.
+func (p *CapacityPlan) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "NODE GROUP\tINSTANCE TYPE\tAWS-VPC NODES\tWORKLOAD CPU\tWORKLOAD MEMORY\tWORKLOAD PODS\tMAX PODS\tCILIUM NODES\tLIMITED BY")
+	for _, g := range p.NodeGroups {
+		group := g.NodeGroup
+		if group == "" {
+			group = "<none>"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%dm\t%dMi\t%d\t%d\t%d\t%s\n",
+			group, g.InstanceType, g.Nodes, g.Workloads.MilliCPU, g.Workloads.Memory>>20,
+			g.Workloads.Pods, g.NodeCapacity.Pods+p.DaemonSetOverhead.Pods, g.RecommendedNodes, g.LimitedBy)
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "\ndaemon set overhead per node: %s\ntotal workloads: %s\n", p.DaemonSetOverhead, p.Workloads)
+	return err
+}
+
+// nodePods returns the pods on a node which have not terminated.
+func (a *Analyser) nodePods(node string) ([]corev1.Pod, error) {
+	pods, err := a.client.CoreV1().Pods(metav1.NamespaceAll).List(a.ctx, metav1.ListOptions{
+		FieldSelector: "spec.nodeName=" + node,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var active []corev1.Pod
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed {
+			active = append(active, pod)
+		}
+	}
+
+	return active, nil
+}
+
+func podRequests(pod *corev1.Pod) Capacity {
+	return specRequests(&pod.Spec)
+}
+
+// specRequests returns the requests of a pod the scheduler accounts for: the
+// larger of the sum of its containers and its largest init container, plus
+// its overhead.
+func specRequests(spec *corev1.PodSpec) Capacity {
+	c := Capacity{Pods: 1}
+
+	for _, container := range spec.Containers {
+		c.MilliCPU += container.Resources.Requests.Cpu().MilliValue()
+		c.Memory += container.Resources.Requests.Memory().Value()
+	}
+
+	for _, container := range spec.InitContainers {
+		if cpu := container.Resources.Requests.Cpu().MilliValue(); cpu > c.MilliCPU {
+			c.MilliCPU = cpu
+		}
+		if memory := container.Resources.Requests.Memory().Value(); memory > c.Memory {
+			c.Memory = memory
+		}
+	}
+
+	c.MilliCPU += spec.Overhead.Cpu().MilliValue()
+	c.Memory += spec.Overhead.Memory().Value()
+
+	return c
+}
+
+func ownerKind(pod *corev1.Pod) string {
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		return owner.Kind
+	}
+	return ""
+}
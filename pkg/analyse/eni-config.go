@@ -0,0 +1,434 @@
+package analyse
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+const (
+	// defaultENIConfigKey is the default node annotation and label selecting
+	// the ENIConfig of a node.
+	defaultENIConfigKey = "k8s.amazonaws.com/eniConfig"
+	// defaultENIConfigName is used by nodes which do not select an ENIConfig.
+	defaultENIConfigName = "default"
+
+	nodeGroupLabel = "eks.amazonaws.com/nodegroup"
+	zoneLabel      = "topology.kubernetes.io/zone"
+
+	// ENINodeGroupLabel selects the CiliumNodeConfig of a node group. The
+	// replacement Cilium nodes of a node group are labelled with the name of
+	// the node group they replace.
+	ENINodeGroupLabel = "cni-migration/eni-node-group"
+
+	// cniConfigurationPath is where the Cilium chart mounts cni.configMap.
+	cniConfigurationPath = "/tmp/cni-configuration"
+)
+
+var (
+	ENIConfigGVR = schema.GroupVersionResource{
+		Group:    "crd.k8s.amazonaws.com",
+		Version:  "v1alpha1",
+		Resource: "eniconfigs",
+	}
+)
+
+// ENIConfig is the pod subnet and security groups of an ENIConfig.
+type ENIConfig struct {
+	Name           string
+	Subnet         string
+	SecurityGroups []string
+}
+
+// ENIConfigNode is a node and the ENIConfig it selects.
+type ENIConfigNode struct {
+	Name      string
+	NodeGroup string
+	Zone      string
+	ENIConfig string
+}
+
+// NodeGroupENIConfig is the pod subnets and security groups of the nodes of
+// a node group, where they differ from the cluster wide CNI configuration.
+type NodeGroupENIConfig struct {
+	NodeGroup      string
+	SubnetIDs      []string
+	SecurityGroups []string
+
+	// CNIConfigKey is the key of its CNI configuration in the CNI ConfigMap.
+	CNIConfigKey string
+}
+
+// ENIConfigTranslation is the VPC CNI custom networking configuration
+// translated into Cilium ENI settings.
+type ENIConfigTranslation struct {
+	ENIConfigs map[string]*ENIConfig
+	Nodes      []ENIConfigNode
+
+	// NodeGroupConfigs are the settings of node groups whose subnets or
+	// security groups cannot be expressed in the cluster wide CNI
+	// configuration, and CiliumNodeConfigs select them for the nodes of
+	// each node group.
+	NodeGroupConfigs  []*NodeGroupENIConfig
+	CiliumNodeConfigs []*unstructured.Unstructured
+
+	// Unmapped lists the configuration which could not be translated.
+	Unmapped []string
+}
+
+// TranslateENIConfig discovers the ENIConfigs and the nodes selecting them,
+// and adds the matching subnets and security groups to the Cilium CNI
+// configuration of t. Cilium picks the subnet in the node's availability zone
+// from the configured subnet IDs, so a single CNI configuration is used if
+// every zone has one pod subnet and all ENIConfigs share security groups.
+// Otherwise, a CNI configuration and a CiliumNodeConfig selecting it are
+// generated per node group, as the existing nodes are replaced.
+func (a *Analyser) TranslateENIConfig(t *AwsNodeTranslation) (*ENIConfigTranslation, error) {
+	if t.Env["AWS_VPC_K8S_CNI_CUSTOM_NETWORK_CFG"] != "true" {
+		a.log.Warn("AWS_VPC_K8S_CNI_CUSTOM_NETWORK_CFG is not enabled, ENIConfigs are not used by aws-node")
+	}
+
+	items, err := a.listOptional(ENIConfigGVR)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &ENIConfigTranslation{
+		ENIConfigs: make(map[string]*ENIConfig),
+	}
+
+	for _, item := range items {
+		subnet, _, _ := unstructured.NestedString(item.Object, "spec", "subnet")
+		groups, _, _ := unstructured.NestedStringSlice(item.Object, "spec", "securityGroups")
+		sort.Strings(groups)
+
+		e.ENIConfigs[item.GetName()] = &ENIConfig{
+			Name:           item.GetName(),
+			Subnet:         subnet,
+			SecurityGroups: groups,
+		}
+	}
+
+	if len(e.ENIConfigs) == 0 {
+		return e, nil
+	}
+
+	if err := e.selectNodes(a, t.Env); err != nil {
+		return nil, err
+	}
+
+	// CiliumNodeConfig is available from Cilium 1.13.
+	var perNodeGroup bool
+	if v, err := version.ParseGeneric(a.config.Cilium.Version); err == nil {
+		perNodeGroup = v.AtLeast(version.MustParseGeneric("1.13"))
+	}
+
+	e.translate(t, a.config.Cilium.Namespace, perNodeGroup)
+
+	// The ENI settings may be the first to need a CNI configuration.
+	t.setCNIValues()
+
+	return e, nil
+}
+
+// selectNodes resolves the ENIConfig each node uses the same way as aws-node,
+// by the ENI_CONFIG_ANNOTATION_DEF annotation, then the ENI_CONFIG_LABEL_DEF
+// label, and the "default" ENIConfig otherwise.
+func (e *ENIConfigTranslation) selectNodes(a *Analyser, env map[string]string) error {
+	annotationKey := defaultENIConfigKey
+	if v := env["ENI_CONFIG_ANNOTATION_DEF"]; v != "" {
+		annotationKey = v
+	}
+
+	labelKey := defaultENIConfigKey
+	if v := env["ENI_CONFIG_LABEL_DEF"]; v != "" {
+		labelKey = v
+	}
+
+	nodes, err := a.client.CoreV1().Nodes().List(a.ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes.Items {
+		name := node.Annotations[annotationKey]
+		if name == "" {
+			name = node.Labels[labelKey]
+		}
+		if name == "" {
+			name = defaultENIConfigName
+		}
+
+		n := ENIConfigNode{
+			Name:      node.Name,
+			NodeGroup: node.Labels[nodeGroupLabel],
+			Zone:      node.Labels[zoneLabel],
+			ENIConfig: name,
+		}
+
+		if _, ok := e.ENIConfigs[name]; !ok {
+			e.Unmapped = append(e.Unmapped, fmt.Sprintf("node %s selects eniconfig %q which does not exist", node.Name, name))
+			continue
+		}
+
+		e.Nodes = append(e.Nodes, n)
+	}
+
+	return nil
+}
+
+func (e *ENIConfigTranslation) translate(t *AwsNodeTranslation, namespace string, perNodeGroup bool) {
+	used := make(map[string]bool)
+	zoneSubnets := make(map[string]map[string]bool)
+
+	for _, n := range e.Nodes {
+		used[n.ENIConfig] = true
+
+		if zoneSubnets[n.Zone] == nil {
+			zoneSubnets[n.Zone] = make(map[string]bool)
+		}
+		zoneSubnets[n.Zone][e.ENIConfigs[n.ENIConfig].Subnet] = true
+	}
+
+	for _, name := range sortedKeys(e.ENIConfigs) {
+		if !used[name] {
+			e.Unmapped = append(e.Unmapped, fmt.Sprintf("eniconfig %s is not selected by any node", name))
+		}
+	}
+
+	if len(used) == 0 {
+		return
+	}
+
+	// Subnets are only unambiguous if every zone uses a single subnet.
+	sharedSubnets := true
+	for zone, subnets := range zoneSubnets {
+		if zone == "" || len(subnets) > 1 {
+			sharedSubnets = false
+		}
+	}
+
+	// Security groups are cluster wide in the CNI configuration.
+	var groups []string
+	sharedGroups := true
+	for name := range used {
+		g := e.ENIConfigs[name].SecurityGroups
+		if groups == nil {
+			groups = g
+		} else if strings.Join(groups, ",") != strings.Join(g, ",") {
+			sharedGroups = false
+		}
+	}
+
+	if sharedSubnets {
+		var subnets []string
+		for name := range used {
+			if s := e.ENIConfigs[name].Subnet; s != "" && !hasString(subnets, s) {
+				subnets = append(subnets, s)
+			}
+		}
+		sort.Strings(subnets)
+
+		t.setCNI("eni", "subnet-ids", subnets)
+		t.setting("ENIConfig subnets", strings.Join(subnets, ","), "CNI eni.subnet-ids")
+	}
+
+	if sharedGroups && len(groups) > 0 {
+		t.setCNI("eni", "security-groups", groups)
+		t.setting("ENIConfig securityGroups", strings.Join(groups, ","), "CNI eni.security-groups")
+	}
+
+	if sharedSubnets && sharedGroups {
+		return
+	}
+
+	if !perNodeGroup {
+		e.Unmapped = append(e.Unmapped, "ENIConfig subnets or security groups differ between nodes, which needs CiliumNodeConfig from Cilium 1.13 to set per node group")
+		return
+	}
+
+	e.translateNodeGroups(t, namespace, !sharedSubnets, !sharedGroups)
+
+	if !sharedSubnets {
+		t.warnf("nodes in the same zone use different ENIConfig subnets, subnets are set per node group with CiliumNodeConfigs")
+	}
+	if !sharedGroups {
+		t.warnf("ENIConfigs use different security groups, security groups are set per node group with CiliumNodeConfigs")
+	}
+}
+
+// translateNodeGroups adds a CNI configuration with the ENIConfig subnets,
+// security groups or both of each node group to t, and a CiliumNodeConfig
+// selecting it for the nodes labelled with the node group in
+// ENINodeGroupLabel. The overrides are keyed by node group rather than by
+// node, as the existing nodes are replaced by new Cilium nodes. Node groups
+// using several subnets in a zone, or different security groups, cannot be
+// expressed and are reported.
+func (e *ENIConfigTranslation) translateNodeGroups(t *AwsNodeTranslation, namespace string, subnets, groups bool) {
+	byGroup := make(map[string][]ENIConfigNode)
+	for _, n := range e.Nodes {
+		byGroup[n.NodeGroup] = append(byGroup[n.NodeGroup], n)
+	}
+
+	names := make([]string, 0, len(byGroup))
+	for name := range byGroup {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		nodes := byGroup[name]
+		if name == "" {
+			e.Unmapped = append(e.Unmapped, fmt.Sprintf("%d nodes have no %s label, their ENIConfig subnets and security groups cannot be set per node group", len(nodes), nodeGroupLabel))
+			continue
+		}
+
+		zoneSubnets := make(map[string][]string)
+		var subnetIDs, securityGroups []string
+		sharedSGs := true
+
+		for i, n := range nodes {
+			config := e.ENIConfigs[n.ENIConfig]
+			if config.Subnet != "" && !hasString(zoneSubnets[n.Zone], config.Subnet) {
+				zoneSubnets[n.Zone] = append(zoneSubnets[n.Zone], config.Subnet)
+				if !hasString(subnetIDs, config.Subnet) {
+					subnetIDs = append(subnetIDs, config.Subnet)
+				}
+			}
+
+			if i == 0 {
+				securityGroups = config.SecurityGroups
+			} else if strings.Join(securityGroups, ",") != strings.Join(config.SecurityGroups, ",") {
+				sharedSGs = false
+			}
+		}
+		sort.Strings(subnetIDs)
+
+		// Cilium picks the subnet in the node's zone, so it can only choose
+		// if the zone is known or the node group has a single subnet.
+		var ambiguous []string
+		for zone, ids := range zoneSubnets {
+			if len(ids) > 1 || (zone == "" && len(subnetIDs) > 1) {
+				ambiguous = append(ambiguous, fmt.Sprintf("%q", zone))
+			}
+		}
+		sort.Strings(ambiguous)
+
+		if subnets && len(ambiguous) > 0 {
+			e.Unmapped = append(e.Unmapped, fmt.Sprintf("node group %s uses several ENIConfig subnets in zones %s, cilium cannot select between them",
+				name, strings.Join(ambiguous, ", ")))
+			continue
+		}
+		if groups && !sharedSGs {
+			e.Unmapped = append(e.Unmapped, fmt.Sprintf("node group %s uses ENIConfigs with different security groups", name))
+			continue
+		}
+
+		c := &NodeGroupENIConfig{
+			NodeGroup:    name,
+			CNIConfigKey: CNIConfigMapKey + "-" + name,
+		}
+		eni := make(map[string]interface{})
+		if subnets && len(subnetIDs) > 0 {
+			c.SubnetIDs = subnetIDs
+			eni["subnet-ids"] = subnetIDs
+		}
+		if groups && len(securityGroups) > 0 {
+			c.SecurityGroups = securityGroups
+			eni["security-groups"] = securityGroups
+		}
+		if len(eni) == 0 {
+			continue
+		}
+
+		if err := t.setNodeGroupCNI(c.CNIConfigKey, eni); err != nil {
+			e.Unmapped = append(e.Unmapped, fmt.Sprintf("node group %s: %s", name, err))
+			continue
+		}
+
+		e.NodeGroupConfigs = append(e.NodeGroupConfigs, c)
+		e.CiliumNodeConfigs = append(e.CiliumNodeConfigs, c.ciliumNodeConfig(namespace))
+	}
+}
+
+// ciliumNodeConfig returns the CiliumNodeConfig making the nodes labelled
+// with the node group read its CNI configuration.
+func (c *NodeGroupENIConfig) ciliumNodeConfig(namespace string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "cilium.io/v2alpha1",
+			"kind":       "CiliumNodeConfig",
+			"metadata": map[string]interface{}{
+				// Node group names may contain underscores, which object
+				// names may not.
+				"name":      "eni-" + strings.ToLower(strings.ReplaceAll(c.NodeGroup, "_", "-")),
+				"namespace": namespace,
+			},
+			"spec": map[string]interface{}{
+				"nodeSelector": map[string]interface{}{
+					"matchLabels": map[string]interface{}{
+						ENINodeGroupLabel: c.NodeGroup,
+					},
+				},
+				"defaults": map[string]interface{}{
+					"read-cni-conf": cniConfigurationPath + "/" + c.CNIConfigKey,
+				},
+			},
+		},
+	}
+}
+
+// NodeGroups returns the ENIConfigs used by each node group.
+func (e *ENIConfigTranslation) NodeGroups() map[string][]string {
+	groups := make(map[string][]string)
+	for _, n := range e.Nodes {
+		if !hasString(groups[n.NodeGroup], n.ENIConfig) {
+			groups[n.NodeGroup] = append(groups[n.NodeGroup], n.ENIConfig)
+		}
+	}
+	for _, configs := range groups {
+		sort.Strings(configs)
+	}
+	return groups
+}
+
+func sortedKeys(m map[string]*ENIConfig) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func hasString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ENIConfigSubnets returns the pod subnets of all ENIConfigs.
+func (a *Analyser) ENIConfigSubnets() ([]string, error) {
+	items, err := a.listOptional(ENIConfigGVR)
+	if err != nil {
+		return nil, err
+	}
+
+	var subnets []string
+	for _, item := range items {
+		subnet, _, _ := unstructured.NestedString(item.Object, "spec", "subnet")
+		if subnet != "" && !hasString(subnets, subnet) {
+			subnets = append(subnets, subnet)
+		}
+	}
+
+	return subnets, nil
+}
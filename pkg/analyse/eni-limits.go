@@ -0,0 +1,217 @@
+package analyse
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/brnck/cni-migration/pkg/values"
+)
+
+// ENILimit is the number of ENIs an instance type can attach, and the number
+// of IPv4 addresses of each ENI.
+type ENILimit struct {
+	ENIs       int
+	IPv4PerENI int
+	VCPUs      int
+}
+
+// eniLimits are the ENI limits of common instance types, from the EC2
+// documentation.
+var eniLimits = map[string]ENILimit{
+	// c5
+	"c5.large":    {ENIs: 3, IPv4PerENI: 10, VCPUs: 2},
+	"c5.xlarge":   {ENIs: 4, IPv4PerENI: 15, VCPUs: 4},
+	"c5.2xlarge":  {ENIs: 4, IPv4PerENI: 15, VCPUs: 8},
+	"c5.4xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 16},
+	"c5.9xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 36},
+	"c5.12xlarge": {ENIs: 8, IPv4PerENI: 30, VCPUs: 48},
+	"c5.18xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 72},
+	"c5.24xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 96},
+	// c6g
+	"c6g.medium":   {ENIs: 2, IPv4PerENI: 4, VCPUs: 1},
+	"c6g.large":    {ENIs: 3, IPv4PerENI: 10, VCPUs: 2},
+	"c6g.xlarge":   {ENIs: 4, IPv4PerENI: 15, VCPUs: 4},
+	"c6g.2xlarge":  {ENIs: 4, IPv4PerENI: 15, VCPUs: 8},
+	"c6g.4xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 16},
+	"c6g.8xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 32},
+	"c6g.12xlarge": {ENIs: 8, IPv4PerENI: 30, VCPUs: 48},
+	"c6g.16xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 64},
+	// c6i
+	"c6i.large":    {ENIs: 3, IPv4PerENI: 10, VCPUs: 2},
+	"c6i.xlarge":   {ENIs: 4, IPv4PerENI: 15, VCPUs: 4},
+	"c6i.2xlarge":  {ENIs: 4, IPv4PerENI: 15, VCPUs: 8},
+	"c6i.4xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 16},
+	"c6i.8xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 32},
+	"c6i.12xlarge": {ENIs: 8, IPv4PerENI: 30, VCPUs: 48},
+	"c6i.16xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 64},
+	"c6i.24xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 96},
+	"c6i.32xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 128},
+	// m5
+	"m5.large":    {ENIs: 3, IPv4PerENI: 10, VCPUs: 2},
+	"m5.xlarge":   {ENIs: 4, IPv4PerENI: 15, VCPUs: 4},
+	"m5.2xlarge":  {ENIs: 4, IPv4PerENI: 15, VCPUs: 8},
+	"m5.4xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 16},
+	"m5.8xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 32},
+	"m5.12xlarge": {ENIs: 8, IPv4PerENI: 30, VCPUs: 48},
+	"m5.16xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 64},
+	"m5.24xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 96},
+	// m5a
+	"m5a.large":    {ENIs: 3, IPv4PerENI: 10, VCPUs: 2},
+	"m5a.xlarge":   {ENIs: 4, IPv4PerENI: 15, VCPUs: 4},
+	"m5a.2xlarge":  {ENIs: 4, IPv4PerENI: 15, VCPUs: 8},
+	"m5a.4xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 16},
+	"m5a.8xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 32},
+	"m5a.12xlarge": {ENIs: 8, IPv4PerENI: 30, VCPUs: 48},
+	"m5a.16xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 64},
+	"m5a.24xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 96},
+	// m6g
+	"m6g.medium":   {ENIs: 2, IPv4PerENI: 4, VCPUs: 1},
+	"m6g.large":    {ENIs: 3, IPv4PerENI: 10, VCPUs: 2},
+	"m6g.xlarge":   {ENIs: 4, IPv4PerENI: 15, VCPUs: 4},
+	"m6g.2xlarge":  {ENIs: 4, IPv4PerENI: 15, VCPUs: 8},
+	"m6g.4xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 16},
+	"m6g.8xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 32},
+	"m6g.12xlarge": {ENIs: 8, IPv4PerENI: 30, VCPUs: 48},
+	"m6g.16xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 64},
+	// m6i
+	"m6i.large":    {ENIs: 3, IPv4PerENI: 10, VCPUs: 2},
+	"m6i.xlarge":   {ENIs: 4, IPv4PerENI: 15, VCPUs: 4},
+	"m6i.2xlarge":  {ENIs: 4, IPv4PerENI: 15, VCPUs: 8},
+	"m6i.4xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 16},
+	"m6i.8xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 32},
+	"m6i.12xlarge": {ENIs: 8, IPv4PerENI: 30, VCPUs: 48},
+	"m6i.16xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 64},
+	"m6i.24xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 96},
+	"m6i.32xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 128},
+	// r5
+	"r5.large":    {ENIs: 3, IPv4PerENI: 10, VCPUs: 2},
+	"r5.xlarge":   {ENIs: 4, IPv4PerENI: 15, VCPUs: 4},
+	"r5.2xlarge":  {ENIs: 4, IPv4PerENI: 15, VCPUs: 8},
+	"r5.4xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 16},
+	"r5.8xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 32},
+	"r5.12xlarge": {ENIs: 8, IPv4PerENI: 30, VCPUs: 48},
+	"r5.16xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 64},
+	"r5.24xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 96},
+	// r5a
+	"r5a.large":    {ENIs: 3, IPv4PerENI: 10, VCPUs: 2},
+	"r5a.xlarge":   {ENIs: 4, IPv4PerENI: 15, VCPUs: 4},
+	"r5a.2xlarge":  {ENIs: 4, IPv4PerENI: 15, VCPUs: 8},
+	"r5a.4xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 16},
+	"r5a.8xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 32},
+	"r5a.12xlarge": {ENIs: 8, IPv4PerENI: 30, VCPUs: 48},
+	"r5a.16xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 64},
+	"r5a.24xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 96},
+	// r6g
+	"r6g.medium":   {ENIs: 2, IPv4PerENI: 4, VCPUs: 1},
+	"r6g.large":    {ENIs: 3, IPv4PerENI: 10, VCPUs: 2},
+	"r6g.xlarge":   {ENIs: 4, IPv4PerENI: 15, VCPUs: 4},
+	"r6g.2xlarge":  {ENIs: 4, IPv4PerENI: 15, VCPUs: 8},
+	"r6g.4xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 16},
+	"r6g.8xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 32},
+	"r6g.12xlarge": {ENIs: 8, IPv4PerENI: 30, VCPUs: 48},
+	"r6g.16xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 64},
+	// r6i
+	"r6i.large":    {ENIs: 3, IPv4PerENI: 10, VCPUs: 2},
+	"r6i.xlarge":   {ENIs: 4, IPv4PerENI: 15, VCPUs: 4},
+	"r6i.2xlarge":  {ENIs: 4, IPv4PerENI: 15, VCPUs: 8},
+	"r6i.4xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 16},
+	"r6i.8xlarge":  {ENIs: 8, IPv4PerENI: 30, VCPUs: 32},
+	"r6i.12xlarge": {ENIs: 8, IPv4PerENI: 30, VCPUs: 48},
+	"r6i.16xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 64},
+	"r6i.24xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 96},
+	"r6i.32xlarge": {ENIs: 15, IPv4PerENI: 50, VCPUs: 128},
+	// t3
+	"t3.nano":    {ENIs: 2, IPv4PerENI: 2, VCPUs: 2},
+	"t3.micro":   {ENIs: 2, IPv4PerENI: 2, VCPUs: 2},
+	"t3.small":   {ENIs: 3, IPv4PerENI: 4, VCPUs: 2},
+	"t3.medium":  {ENIs: 3, IPv4PerENI: 6, VCPUs: 2},
+	"t3.large":   {ENIs: 3, IPv4PerENI: 12, VCPUs: 2},
+	"t3.xlarge":  {ENIs: 4, IPv4PerENI: 15, VCPUs: 4},
+	"t3.2xlarge": {ENIs: 4, IPv4PerENI: 15, VCPUs: 8},
+	// t3a
+	"t3a.nano":    {ENIs: 2, IPv4PerENI: 2, VCPUs: 2},
+	"t3a.micro":   {ENIs: 2, IPv4PerENI: 2, VCPUs: 2},
+	"t3a.small":   {ENIs: 3, IPv4PerENI: 4, VCPUs: 2},
+	"t3a.medium":  {ENIs: 3, IPv4PerENI: 6, VCPUs: 2},
+	"t3a.large":   {ENIs: 3, IPv4PerENI: 12, VCPUs: 2},
+	"t3a.xlarge":  {ENIs: 4, IPv4PerENI: 15, VCPUs: 4},
+	"t3a.2xlarge": {ENIs: 4, IPv4PerENI: 15, VCPUs: 8},
+}
+
+// InstanceENILimit returns the ENI limit of an instance type, and false if
+// the instance type is unknown.
+func InstanceENILimit(instanceType string) (ENILimit, bool) {
+	l, ok := eniLimits[instanceType]
+	return l, ok
+}
+
+// AllocatablePods returns the number of pods a node can run when pod IPs are
+// allocated from ENIs. The ENIs before firstInterfaceIndex are not used for
+// pods, and with prefix delegation every secondary IP is a /28 prefix. Two
+// host network pods, the CNI agent and kube-proxy, are added.
+func (l ENILimit) AllocatablePods(firstInterfaceIndex int, prefixDelegation bool) int {
+	ips := l.IPv4PerENI - 1
+	if prefixDelegation {
+		ips *= 16
+	}
+
+	return (l.ENIs-firstInterfaceIndex)*ips + 2
+}
+
+// MaxPods returns the kubelet max pods of an instance type, the same way as
+// the EKS max pods calculation: the allocatable pods, limited with prefix
+// delegation.
+func (l ENILimit) MaxPods(firstInterfaceIndex int, prefixDelegation bool) int {
+	maxPods := l.AllocatablePods(firstInterfaceIndex, prefixDelegation)
+
+	// The kubelet limits recommended by EKS with prefix delegation.
+	if prefixDelegation {
+		limit := 110
+		if l.VCPUs > 30 {
+			limit = 250
+		}
+		if maxPods > limit {
+			maxPods = limit
+		}
+	}
+
+	return maxPods
+}
+
+// ENISettings are the Cilium ENI settings which decide the pods per node.
+type ENISettings struct {
+	// FirstInterfaceIndex is 1 with custom networking, where pods do not use
+	// the primary ENI.
+	FirstInterfaceIndex int
+	PrefixDelegation    bool
+}
+
+// ENISettings returns the ENI settings Cilium runs with. The first interface
+// index follows the aws-node custom networking, which the translated CNI
+// configuration keeps, and prefix delegation is read from the Cilium values,
+// as Cilium only uses it if eni.awsEnablePrefixDelegation is set. false is
+// returned if aws-node is not found.
+func (a *Analyser) ENISettings() (ENISettings, bool, error) {
+	var s ENISettings
+
+	vals, err := values.Build(a.config, values.PreMigration)
+	if err != nil {
+		return s, false, err
+	}
+	if enabled, err := vals.PathValue("eni.awsEnablePrefixDelegation"); err == nil {
+		s.PrefixDelegation, _ = enabled.(bool)
+	}
+
+	t, err := a.TranslateAwsNode()
+	if apierrors.IsNotFound(err) {
+		return s, false, nil
+	}
+	if err != nil {
+		return s, false, err
+	}
+
+	if t.Env["AWS_VPC_K8S_CNI_CUSTOM_NETWORK_CFG"] == "true" {
+		s.FirstInterfaceIndex = 1
+	}
+
+	return s, true, nil
+}
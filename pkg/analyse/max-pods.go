@@ -0,0 +1,84 @@
+package analyse
+
+import (
+	"fmt"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MaxPodsMismatch is a node whose kubelet max pods disagrees with the pods
+// Cilium can allocate IPs for in ENI mode.
+type MaxPodsMismatch struct {
+	Node         string
+	InstanceType string
+	// KubeletMaxPods is the pod capacity of the node.
+	KubeletMaxPods int
+	// CiliumAllocatable is the number of pods Cilium can allocate IPs for.
+	CiliumAllocatable int
+	// Recommended is the EKS max pods of the instance type.
+	Recommended int
+	// Cilium is true if the node is labelled for Cilium. Other nodes run
+	// aws-node until they are decommissioned.
+	Cilium bool
+}
+
+// Exceeds is true if the kubelet admits more pods than Cilium can allocate
+// IPs for, so pods fail to start once the IPs are exhausted.
+func (m *MaxPodsMismatch) Exceeds() bool {
+	return m.KubeletMaxPods > m.CiliumAllocatable
+}
+
+// MaxPodsMismatches compares the pod capacity of every node with the pods
+// Cilium can allocate IPs for on its instance type, from the built-in ENI
+// limits and the ENI settings of Cilium.
+// Nodes admitting more pods than Cilium can allocate IPs for, or fewer than
+// the EKS max pods of their instance type, are returned, marking the nodes
+// labelled for Cilium. Nodes of unknown instance types are returned as
+// warnings.
+func (a *Analyser) MaxPodsMismatches() ([]*MaxPodsMismatch, []string, error) {
+	settings, found, err := a.ENISettings()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var warnings []string
+	if !found {
+		warnings = append(warnings, "aws-node not found, assuming pods use the primary ENI")
+	}
+
+	nodes, err := a.client.CoreV1().Nodes().List(a.ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var mismatches []*MaxPodsMismatch
+	for _, node := range nodes.Items {
+		instanceType := node.Labels[instanceTypeLabel]
+
+		limit, ok := InstanceENILimit(instanceType)
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("instance type %q of node %s has no known ENI limits, not checking its max pods", instanceType, node.Name))
+			continue
+		}
+
+		m := &MaxPodsMismatch{
+			Node:              node.Name,
+			InstanceType:      instanceType,
+			KubeletMaxPods:    int(node.Status.Capacity.Pods().Value()),
+			CiliumAllocatable: limit.AllocatablePods(settings.FirstInterfaceIndex, settings.PrefixDelegation),
+			Recommended:       limit.MaxPods(settings.FirstInterfaceIndex, settings.PrefixDelegation),
+			Cilium:            node.Labels[a.config.Labels.Cilium] == a.config.Labels.Value,
+		}
+
+		if m.Exceeds() || m.KubeletMaxPods < m.Recommended {
+			mismatches = append(mismatches, m)
+		}
+	}
+
+	sort.Slice(mismatches, func(i, j int) bool {
+		return mismatches[i].Node < mismatches[j].Node
+	})
+
+	return mismatches, warnings, nil
+}
@@ -0,0 +1,650 @@
+package analyse
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+const (
+	// PolicyEngineVpcCni is the network policy agent of the AWS VPC CNI.
+	PolicyEngineVpcCni = "aws-network-policy-agent"
+	// PolicyEngineCalico is Calico, usually installed in policy only mode
+	// alongside the AWS VPC CNI.
+	PolicyEngineCalico = "calico"
+
+	awsNetworkPolicyAgentContainer = "aws-network-policy-agent"
+
+	podNamespaceLabel       = "io.kubernetes.pod.namespace"
+	namespaceLabelsPrefix   = "io.cilium.k8s.namespace.labels."
+	enableNetworkPolicyFlag = "--enable-network-policy=true"
+)
+
+var (
+	PolicyEndpointGVR = schema.GroupVersionResource{
+		Group:    "networking.k8s.aws",
+		Version:  "v1alpha1",
+		Resource: "policyendpoints",
+	}
+
+	CalicoGlobalNetworkPolicyGVR = schema.GroupVersionResource{
+		Group:    "crd.projectcalico.org",
+		Version:  "v1",
+		Resource: "globalnetworkpolicies",
+	}
+
+	CalicoNetworkPolicyGVR = schema.GroupVersionResource{
+		Group:    "crd.projectcalico.org",
+		Version:  "v1",
+		Resource: "networkpolicies",
+	}
+
+	// calicoNodeDaemonSets are the namespaces and names calico-node is
+	// installed as.
+	calicoNodeDaemonSets = [][2]string{
+		{"kube-system", "calico-node"},
+		{"calico-system", "calico-node"},
+	}
+)
+
+// PolicyFinding is a policy construct which Cilium handles differently.
+type PolicyFinding struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Message   string
+
+	// Translatable is true if the CiliumNetworkPolicy equivalent keeps the
+	// current behaviour.
+	Translatable bool
+}
+
+// NetworkPolicyReport is the inventory of network policies and the engines
+// currently enforcing them.
+type NetworkPolicyReport struct {
+	Engines []string
+
+	NetworkPolicies             []networkingv1.NetworkPolicy
+	PolicyEndpoints             int
+	CalicoGlobalNetworkPolicies int
+	CalicoNetworkPolicies       int
+
+	Findings []PolicyFinding
+
+	// podIPs are the IPs of the pods of each namespace.
+	podIPs  map[string][]net.IP
+	nodeIPs []net.IP
+
+	portRanges bool
+}
+
+// NetworkPolicies detects the network policy engines, inventories the
+// NetworkPolicies and engine specific policy resources, and flags the
+// constructs Cilium handles differently.
+func (a *Analyser) NetworkPolicies() (*NetworkPolicyReport, error) {
+	r := new(NetworkPolicyReport)
+
+	// Port ranges (endPort) are supported from Cilium 1.14.
+	if v, err := version.ParseGeneric(a.config.Cilium.Version); err == nil {
+		r.portRanges = v.AtLeast(version.MustParseGeneric("1.14"))
+	}
+
+	engines, err := a.policyEngines()
+	if err != nil {
+		return nil, err
+	}
+	r.Engines = engines
+
+	policies, err := a.client.NetworkingV1().NetworkPolicies("").List(a.ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	r.NetworkPolicies = policies.Items
+
+	for gvr, count := range map[schema.GroupVersionResource]*int{
+		PolicyEndpointGVR:            &r.PolicyEndpoints,
+		CalicoGlobalNetworkPolicyGVR: &r.CalicoGlobalNetworkPolicies,
+		CalicoNetworkPolicyGVR:       &r.CalicoNetworkPolicies,
+	} {
+		list, err := a.listOptional(gvr)
+		if err != nil {
+			return nil, err
+		}
+
+		*count = len(list)
+
+		for _, item := range list {
+			if gvr == PolicyEndpointGVR {
+				continue
+			}
+			r.Findings = append(r.Findings, PolicyFinding{
+				Kind:      item.GetKind() + "." + gvr.Group,
+				Namespace: item.GetNamespace(),
+				Name:      item.GetName(),
+				Message:   "calico specific policy is not enforced by cilium and must be translated manually",
+			})
+		}
+	}
+
+	if err := a.clusterIPs(r); err != nil {
+		return nil, err
+	}
+
+	for _, np := range r.NetworkPolicies {
+		r.Findings = append(r.Findings, r.networkPolicyFindings(&np)...)
+	}
+
+	sort.SliceStable(r.Findings, func(i, j int) bool {
+		fi, fj := r.Findings[i], r.Findings[j]
+		if fi.Kind != fj.Kind {
+			return fi.Kind < fj.Kind
+		}
+		if fi.Namespace != fj.Namespace {
+			return fi.Namespace < fj.Namespace
+		}
+		return fi.Name < fj.Name
+	})
+
+	return r, nil
+}
+
+// policyEngines returns the network policy engines running in the cluster.
+func (a *Analyser) policyEngines() ([]string, error) {
+	var engines []string
+
+	ds, err := a.client.AppsV1().
+		DaemonSets(a.config.AwsVpcCni.Namespace).
+		Get(a.ctx, a.config.AwsVpcCni.DaemonsetName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		for _, c := range ds.Spec.Template.Spec.Containers {
+			if c.Name == awsNetworkPolicyAgentContainer && hasString(c.Args, enableNetworkPolicyFlag) {
+				engines = append(engines, PolicyEngineVpcCni)
+			}
+		}
+	}
+
+	for _, calico := range calicoNodeDaemonSets {
+		_, err := a.client.AppsV1().DaemonSets(calico[0]).Get(a.ctx, calico[1], metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		engines = append(engines, PolicyEngineCalico)
+		break
+	}
+
+	return engines, nil
+}
+
+// listOptional lists a custom resource, which is empty if the CRD is not
+// installed.
+func (a *Analyser) listOptional(gvr schema.GroupVersionResource) ([]unstructured.Unstructured, error) {
+	list, err := a.dynamicClient.Resource(gvr).List(a.ctx, metav1.ListOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %s", gvr.GroupResource(), err)
+	}
+	return list.Items, nil
+}
+
+// clusterIPs collects the pod and node IPs that ipBlocks are checked against.
+func (a *Analyser) clusterIPs(r *NetworkPolicyReport) error {
+	pods, err := a.client.CoreV1().Pods("").List(a.ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	r.podIPs = make(map[string][]net.IP)
+	for _, pod := range pods.Items {
+		if pod.Spec.HostNetwork {
+			continue
+		}
+		if ip := net.ParseIP(pod.Status.PodIP); ip != nil {
+			r.podIPs[pod.Namespace] = append(r.podIPs[pod.Namespace], ip)
+		}
+	}
+
+	nodes, err := a.client.CoreV1().Nodes().List(a.ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes.Items {
+		for _, addr := range node.Status.Addresses {
+			if addr.Type != corev1.NodeInternalIP {
+				continue
+			}
+			if ip := net.ParseIP(addr.Address); ip != nil {
+				r.nodeIPs = append(r.nodeIPs, ip)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *NetworkPolicyReport) networkPolicyFindings(np *networkingv1.NetworkPolicy) []PolicyFinding {
+	var findings []PolicyFinding
+
+	finding := func(translatable bool, format string, args ...interface{}) {
+		findings = append(findings, PolicyFinding{
+			Kind:         "NetworkPolicy",
+			Namespace:    np.Namespace,
+			Name:         np.Name,
+			Message:      fmt.Sprintf(format, args...),
+			Translatable: translatable,
+		})
+	}
+
+	var peers []networkingv1.NetworkPolicyPeer
+	var ports []networkingv1.NetworkPolicyPort
+	for _, rule := range np.Spec.Ingress {
+		peers = append(peers, rule.From...)
+		ports = append(ports, rule.Ports...)
+	}
+	for _, rule := range np.Spec.Egress {
+		peers = append(peers, rule.To...)
+		ports = append(ports, rule.Ports...)
+	}
+
+	for _, peer := range peers {
+		if peer.IPBlock == nil {
+			continue
+		}
+
+		sel := r.selectIPBlock(peer.IPBlock)
+
+		switch {
+		case len(sel.partialNamespaces) > 0:
+			finding(false, "ipBlock %s matches the IPs of some pods of namespaces %s, cilium selects pods by identity and not by IP, replace it with pod selectors",
+				peer.IPBlock.CIDR, strings.Join(sel.partialNamespaces, ", "))
+		case len(sel.namespaces) > 0:
+			finding(true, "ipBlock %s matches the IPs of all pods of namespaces %s, cilium selects pods by identity, translated to namespace selectors",
+				peer.IPBlock.CIDR, strings.Join(sel.namespaces, ", "))
+		}
+
+		switch {
+		case sel.someNodes:
+			finding(false, "ipBlock %s matches the IPs of some nodes, cilium only selects nodes as the host and remote-node entities, which include every node",
+				peer.IPBlock.CIDR)
+		case sel.allNodes:
+			finding(true, "ipBlock %s matches the IPs of all nodes, cilium selects nodes by identity, translated to the host and remote-node entities",
+				peer.IPBlock.CIDR)
+		}
+	}
+
+	for _, port := range ports {
+		if port.EndPort != nil && !r.portRanges {
+			finding(false, "port range %s-%d requires cilium 1.14 or later", port.Port, *port.EndPort)
+		}
+	}
+
+	return findings
+}
+
+// ipBlockSelection is what an ipBlock selects by the current pod and node
+// IPs.
+type ipBlockSelection struct {
+	// namespaces are the namespaces all of whose pods are in the ipBlock.
+	namespaces []string
+	// partialNamespaces are the namespaces only some of whose pods are in the
+	// ipBlock.
+	partialNamespaces []string
+
+	allNodes, someNodes bool
+}
+
+// selectIPBlock returns the namespaces and nodes an ipBlock selects. Only
+// selections covering whole namespaces or all nodes have a Cilium
+// equivalent, namespace selectors or the host and remote-node entities, which
+// is not broader than the ipBlock.
+func (r *NetworkPolicyReport) selectIPBlock(block *networkingv1.IPBlock) ipBlockSelection {
+	var sel ipBlockSelection
+
+	namespaces := make([]string, 0, len(r.podIPs))
+	for ns := range r.podIPs {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	for _, ns := range namespaces {
+		switch matched := ipBlockMatches(block, r.podIPs[ns]); {
+		case matched == len(r.podIPs[ns]):
+			sel.namespaces = append(sel.namespaces, ns)
+		case matched > 0:
+			sel.partialNamespaces = append(sel.partialNamespaces, ns)
+		}
+	}
+
+	switch matched := ipBlockMatches(block, r.nodeIPs); {
+	case matched > 0 && matched == len(r.nodeIPs):
+		sel.allNodes = true
+	case matched > 0:
+		sel.someNodes = true
+	}
+
+	return sel
+}
+
+// ipBlockMatches returns the number of ips in the ipBlock.
+func ipBlockMatches(block *networkingv1.IPBlock, ips []net.IP) int {
+	_, cidr, err := net.ParseCIDR(block.CIDR)
+	if err != nil {
+		return 0
+	}
+
+	var except []*net.IPNet
+	for _, e := range block.Except {
+		if _, n, err := net.ParseCIDR(e); err == nil {
+			except = append(except, n)
+		}
+	}
+
+	var matched int
+	for _, ip := range ips {
+		if !cidr.Contains(ip) {
+			continue
+		}
+
+		excluded := false
+		for _, n := range except {
+			if n.Contains(ip) {
+				excluded = true
+				break
+			}
+		}
+
+		if !excluded {
+			matched++
+		}
+	}
+
+	return matched
+}
+
+// NeedsTranslation returns the NetworkPolicies with translatable findings.
+func (r *NetworkPolicyReport) NeedsTranslation() []networkingv1.NetworkPolicy {
+	needs := make(map[string]bool)
+	for _, f := range r.Findings {
+		if f.Kind == "NetworkPolicy" && f.Translatable {
+			needs[f.Namespace+"/"+f.Name] = true
+		}
+	}
+
+	var policies []networkingv1.NetworkPolicy
+	for _, np := range r.NetworkPolicies {
+		if needs[np.Namespace+"/"+np.Name] {
+			policies = append(policies, np)
+		}
+	}
+
+	return policies
+}
+
+// CiliumNetworkPolicy translates a NetworkPolicy into its CiliumNetworkPolicy
+// equivalent. ipBlocks matching the IPs of all pods of namespaces, or of all
+// nodes, additionally allow those namespaces, or the host and remote-node
+// entities. ipBlocks matching only some of them are left as CIDRs, which
+// Cilium does not apply to pods or nodes, and are reported as not
+// translatable.
+func (r *NetworkPolicyReport) CiliumNetworkPolicy(np *networkingv1.NetworkPolicy) *unstructured.Unstructured {
+	spec := map[string]interface{}{
+		"endpointSelector": labelSelector(&np.Spec.PodSelector, nil),
+	}
+
+	ingress, egress := false, false
+	for _, t := range np.Spec.PolicyTypes {
+		ingress = ingress || t == networkingv1.PolicyTypeIngress
+		egress = egress || t == networkingv1.PolicyTypeEgress
+	}
+	if len(np.Spec.PolicyTypes) == 0 {
+		ingress = true
+		egress = len(np.Spec.Egress) > 0
+	}
+
+	if ingress {
+		var rules []interface{}
+		for _, rule := range np.Spec.Ingress {
+			rules = append(rules, r.ciliumRules(np.Namespace, "from", rule.From, rule.Ports)...)
+		}
+		if len(rules) == 0 {
+			// An empty rule enables default deny.
+			rules = []interface{}{map[string]interface{}{}}
+		}
+		spec["ingress"] = rules
+	}
+
+	if egress {
+		var rules []interface{}
+		for _, rule := range np.Spec.Egress {
+			rules = append(rules, r.ciliumRules(np.Namespace, "to", rule.To, rule.Ports)...)
+		}
+		if len(rules) == 0 {
+			rules = []interface{}{map[string]interface{}{}}
+		}
+		spec["egress"] = rules
+	}
+
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "cilium.io/v2",
+			"kind":       "CiliumNetworkPolicy",
+			"metadata": map[string]interface{}{
+				"name":      np.Name,
+				"namespace": np.Namespace,
+			},
+			"spec": spec,
+		},
+	}
+}
+
+// ciliumRules translates the peers and ports of a NetworkPolicy rule. Cilium
+// does not combine endpoint, CIDR and entity peers in one rule, so a rule is
+// returned for each kind of peer.
+func (r *NetworkPolicyReport) ciliumRules(namespace, direction string, peers []networkingv1.NetworkPolicyPeer, ports []networkingv1.NetworkPolicyPort) []interface{} {
+	var endpoints, cidrs, entities []interface{}
+
+	if len(peers) == 0 {
+		entities = append(entities, "all")
+	}
+
+	for _, peer := range peers {
+		if peer.IPBlock != nil {
+			cidr := map[string]interface{}{"cidr": peer.IPBlock.CIDR}
+			if len(peer.IPBlock.Except) > 0 {
+				cidr["except"] = stringsToInterfaces(peer.IPBlock.Except)
+			}
+			cidrs = append(cidrs, cidr)
+
+			sel := r.selectIPBlock(peer.IPBlock)
+			if len(sel.partialNamespaces) == 0 {
+				for _, ns := range sel.namespaces {
+					endpoints = append(endpoints, map[string]interface{}{
+						"matchLabels": map[string]interface{}{podNamespaceLabel: ns},
+					})
+				}
+			}
+			if sel.allNodes {
+				entities = appendUnique(entities, "host")
+				entities = appendUnique(entities, "remote-node")
+			}
+			continue
+		}
+
+		endpoints = append(endpoints, peerSelector(namespace, &peer))
+	}
+
+	var toPorts []interface{}
+	if len(ports) > 0 {
+		var portRules []interface{}
+		for _, port := range ports {
+			p := map[string]interface{}{}
+			if port.Port != nil {
+				p["port"] = port.Port.String()
+			}
+			if port.EndPort != nil {
+				p["endPort"] = int64(*port.EndPort)
+			}
+			protocol := corev1.ProtocolTCP
+			if port.Protocol != nil {
+				protocol = *port.Protocol
+			}
+			p["protocol"] = string(protocol)
+			portRules = append(portRules, p)
+		}
+		toPorts = []interface{}{map[string]interface{}{"ports": portRules}}
+	}
+
+	var rules []interface{}
+	for field, list := range map[string][]interface{}{
+		direction + "Endpoints": endpoints,
+		direction + "CIDRSet":   cidrs,
+		direction + "Entities":  entities,
+	} {
+		if len(list) == 0 {
+			continue
+		}
+
+		rule := map[string]interface{}{field: list}
+		if toPorts != nil {
+			rule["toPorts"] = toPorts
+		}
+		rules = append(rules, rule)
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		return ruleField(rules[i]) < ruleField(rules[j])
+	})
+
+	return rules
+}
+
+// peerSelector translates a pod and namespace selector peer into a Cilium
+// endpoint selector.
+func peerSelector(namespace string, peer *networkingv1.NetworkPolicyPeer) map[string]interface{} {
+	var selector map[string]interface{}
+	if peer.PodSelector != nil {
+		selector = labelSelector(peer.PodSelector, nil)
+	} else {
+		selector = map[string]interface{}{}
+	}
+
+	matchLabels, _ := selector["matchLabels"].(map[string]interface{})
+	if matchLabels == nil {
+		matchLabels = map[string]interface{}{}
+	}
+	matchExpressions, _ := selector["matchExpressions"].([]interface{})
+
+	switch {
+	case peer.NamespaceSelector == nil:
+		matchLabels[podNamespaceLabel] = namespace
+
+	case len(peer.NamespaceSelector.MatchLabels) == 0 && len(peer.NamespaceSelector.MatchExpressions) == 0:
+		matchExpressions = append(matchExpressions, map[string]interface{}{
+			"key":      podNamespaceLabel,
+			"operator": string(metav1.LabelSelectorOpExists),
+		})
+
+	default:
+		ns := labelSelector(peer.NamespaceSelector, func(key string) string {
+			return namespaceLabelsPrefix + key
+		})
+		if l, ok := ns["matchLabels"].(map[string]interface{}); ok {
+			for k, v := range l {
+				matchLabels[k] = v
+			}
+		}
+		if e, ok := ns["matchExpressions"].([]interface{}); ok {
+			matchExpressions = append(matchExpressions, e...)
+		}
+	}
+
+	selector = map[string]interface{}{}
+	if len(matchLabels) > 0 {
+		selector["matchLabels"] = matchLabels
+	}
+	if len(matchExpressions) > 0 {
+		selector["matchExpressions"] = matchExpressions
+	}
+
+	return selector
+}
+
+// labelSelector converts a label selector to unstructured, prefixing keys if
+// prefix is not nil.
+func labelSelector(ls *metav1.LabelSelector, prefix func(string) string) map[string]interface{} {
+	if prefix == nil {
+		prefix = func(key string) string { return key }
+	}
+
+	selector := map[string]interface{}{}
+
+	if len(ls.MatchLabels) > 0 {
+		matchLabels := map[string]interface{}{}
+		for k, v := range ls.MatchLabels {
+			matchLabels[prefix(k)] = v
+		}
+		selector["matchLabels"] = matchLabels
+	}
+
+	if len(ls.MatchExpressions) > 0 {
+		var matchExpressions []interface{}
+		for _, e := range ls.MatchExpressions {
+			expr := map[string]interface{}{
+				"key":      prefix(e.Key),
+				"operator": string(e.Operator),
+			}
+			if len(e.Values) > 0 {
+				expr["values"] = stringsToInterfaces(e.Values)
+			}
+			matchExpressions = append(matchExpressions, expr)
+		}
+		selector["matchExpressions"] = matchExpressions
+	}
+
+	return selector
+}
+
+func ruleField(rule interface{}) string {
+	for k := range rule.(map[string]interface{}) {
+		if k != "toPorts" {
+			return k
+		}
+	}
+	return ""
+}
+
+func stringsToInterfaces(s []string) []interface{} {
+	out := make([]interface{}, len(s))
+	for i := range s {
+		out[i] = s[i]
+	}
+	return out
+}
+
+func appendUnique(list []interface{}, s string) []interface{} {
+	for _, l := range list {
+		if l == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
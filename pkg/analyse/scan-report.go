@@ -0,0 +1,96 @@
+package analyse
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats of the scan report.
+const (
+	FormatTable    = "table"
+	FormatJSON     = "json"
+	FormatMarkdown = "markdown"
+)
+
+// ValidateFormat returns an error if format is not a report format.
+func ValidateFormat(format string) error {
+	switch format {
+	case FormatTable, FormatJSON, FormatMarkdown:
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q, expected one of %s, %s, %s",
+			format, FormatTable, FormatJSON, FormatMarkdown)
+	}
+}
+
+// AtRisk returns the number of workloads with any risk.
+func (r *ScanReport) AtRisk() int {
+	var n int
+	for _, wl := range r.Workloads {
+		if wl.Risk != RiskNone {
+			n++
+		}
+	}
+	return n
+}
+
+// Write writes the report to w in format.
+func (r *ScanReport) Write(w io.Writer, format string) error {
+	switch format {
+	case FormatTable:
+		return r.writeTable(w)
+	case FormatJSON:
+		return r.writeJSON(w)
+	case FormatMarkdown:
+		return r.writeMarkdown(w)
+	default:
+		return ValidateFormat(format)
+	}
+}
+
+func (r *ScanReport) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "RISK\tNAMESPACE\tKIND\tNAME\tPODS\tREASONS")
+	for _, wl := range r.Workloads {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n",
+			wl.Risk, wl.Namespace, wl.Kind, wl.Name, wl.Pods, strings.Join(wl.Reasons, "; "))
+	}
+
+	return tw.Flush()
+}
+
+func (r *ScanReport) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func (r *ScanReport) writeMarkdown(w io.Writer) error {
+	var b strings.Builder
+
+	b.WriteString("# Workload compatibility scan\n\n")
+
+	counts := make(map[Risk]int)
+	for _, wl := range r.Workloads {
+		counts[wl.Risk]++
+	}
+	for _, risk := range []Risk{RiskHigh, RiskMedium, RiskLow, RiskNone} {
+		if counts[risk] > 0 {
+			fmt.Fprintf(&b, "- %s: %d workloads\n", risk, counts[risk])
+		}
+	}
+
+	b.WriteString("\n| Risk | Namespace | Kind | Name | Pods | Reasons |\n")
+	b.WriteString("|---|---|---|---|---|---|\n")
+	for _, wl := range r.Workloads {
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %d | %s |\n",
+			wl.Risk, wl.Namespace, wl.Kind, wl.Name, wl.Pods, strings.Join(wl.Reasons, "<br>"))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,268 @@
+package analyse
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Risk is how likely a workload is to be affected by the CNI change.
+type Risk int
+
+const (
+	RiskNone Risk = iota
+	RiskLow
+	RiskMedium
+	RiskHigh
+)
+
+func (r Risk) String() string {
+	switch r {
+	case RiskLow:
+		return "low"
+	case RiskMedium:
+		return "medium"
+	case RiskHigh:
+		return "high"
+	default:
+		return "none"
+	}
+}
+
+func (r Risk) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+const (
+	podENIResource   = "vpc.amazonaws.com/pod-eni"
+	podENIAnnotation = "vpc.amazonaws.com/pod-eni"
+)
+
+// staticIPAnnotations are pod annotations requesting fixed pod IPs, which
+// Cilium does not honour.
+var staticIPAnnotations = []string{
+	"cni.projectcalico.org/ipAddrs",
+	"cni.projectcalico.org/ipv4pools",
+	"vpc.amazonaws.com/private-ipv4-address",
+}
+
+// WorkloadRisk is the risk of a workload with the reasons for it.
+type WorkloadRisk struct {
+	Namespace string   `json:"namespace"`
+	Kind      string   `json:"kind"`
+	Name      string   `json:"name"`
+	Pods      int      `json:"pods"`
+	Risk      Risk     `json:"risk"`
+	Reasons   []string `json:"reasons"`
+}
+
+// ScanReport is the risk of every workload in the cluster.
+type ScanReport struct {
+	Workloads []*WorkloadRisk `json:"workloads"`
+}
+
+// Scan walks all pods and controllers and classifies the risk of each
+// workload being affected by the migration:
+// - high: pods with branch ENIs, eniConfig annotations or static IPs
+// - high: pods which are addressed by IP
+// - medium: pods using host ports
+// - low: host network pods, which are not managed by Cilium
+// Workloads are included in the report if they have any risk, or if all is
+// true.
+func (a *Analyser) Scan(all bool) (*ScanReport, error) {
+	namespace := metav1.NamespaceAll
+	workloads := make(map[string]*WorkloadRisk)
+
+	workload := func(namespace, kind, name string) *WorkloadRisk {
+		key := namespace + "/" + kind + "/" + name
+		if w, ok := workloads[key]; ok {
+			return w
+		}
+		w := &WorkloadRisk{Namespace: namespace, Kind: kind, Name: name}
+		workloads[key] = w
+		return w
+	}
+
+	addressed, err := a.addressedIPs(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := a.client.CoreV1().Pods(namespace).List(a.ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make(map[string]string)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+
+		key, err := a.podWorkload(pod, owners)
+		if err != nil {
+			return nil, err
+		}
+		parts := strings.SplitN(key, "/", 3)
+
+		w := workload(parts[0], parts[1], parts[2])
+		w.Pods++
+		w.check(&pod.ObjectMeta, &pod.Spec)
+
+		if reason, ok := addressed[pod.Status.PodIP]; ok && !pod.Spec.HostNetwork {
+			w.add(RiskHigh, reason)
+		}
+	}
+
+	// Controllers without running pods are scanned from their templates.
+	if err := a.scanControllers(namespace, workload); err != nil {
+		return nil, err
+	}
+
+	r := new(ScanReport)
+	for _, w := range workloads {
+		if w.Risk == RiskNone && !all {
+			continue
+		}
+		sort.Strings(w.Reasons)
+		r.Workloads = append(r.Workloads, w)
+	}
+
+	sort.Slice(r.Workloads, func(i, j int) bool {
+		wi, wj := r.Workloads[i], r.Workloads[j]
+		if wi.Risk != wj.Risk {
+			return wi.Risk > wj.Risk
+		}
+		if wi.Namespace != wj.Namespace {
+			return wi.Namespace < wj.Namespace
+		}
+		if wi.Kind != wj.Kind {
+			return wi.Kind < wj.Kind
+		}
+		return wi.Name < wj.Name
+	})
+
+	return r, nil
+}
+
+func (a *Analyser) scanControllers(namespace string, workload func(namespace, kind, name string) *WorkloadRisk) error {
+	apps := a.client.AppsV1()
+
+	deployments, err := apps.Deployments(namespace).List(a.ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, d := range deployments.Items {
+		workload(d.Namespace, "Deployment", d.Name).check(&d.Spec.Template.ObjectMeta, &d.Spec.Template.Spec)
+	}
+
+	statefulsets, err := apps.StatefulSets(namespace).List(a.ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, s := range statefulsets.Items {
+		workload(s.Namespace, "StatefulSet", s.Name).check(&s.Spec.Template.ObjectMeta, &s.Spec.Template.Spec)
+	}
+
+	daemonsets, err := apps.DaemonSets(namespace).List(a.ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, d := range daemonsets.Items {
+		workload(d.Namespace, "DaemonSet", d.Name).check(&d.Spec.Template.ObjectMeta, &d.Spec.Template.Spec)
+	}
+
+	cronjobs, err := a.client.BatchV1().CronJobs(namespace).List(a.ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, c := range cronjobs.Items {
+		template := &c.Spec.JobTemplate.Spec.Template
+		workload(c.Namespace, "CronJob", c.Name).check(&template.ObjectMeta, &template.Spec)
+	}
+
+	return nil
+}
+
+// addressedIPs returns the pod IPs that are addressed directly, by the
+// manually managed Endpoints of Services without a selector.
+func (a *Analyser) addressedIPs(namespace string) (map[string]string, error) {
+	addressed := make(map[string]string)
+
+	services, err := a.client.CoreV1().Services(namespace).List(a.ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, svc := range services.Items {
+		if len(svc.Spec.Selector) > 0 || svc.Spec.Type == corev1.ServiceTypeExternalName {
+			continue
+		}
+
+		ep, err := a.client.CoreV1().Endpoints(svc.Namespace).Get(a.ctx, svc.Name, metav1.GetOptions{})
+		if err != nil {
+			continue
+		}
+
+		for _, subset := range ep.Subsets {
+			for _, addr := range subset.Addresses {
+				if addr.TargetRef == nil && net.ParseIP(addr.IP) != nil {
+					addressed[addr.IP] = "pod IP is used in the endpoints of service " + svc.Namespace + "/" + svc.Name
+				}
+			}
+		}
+	}
+
+	return addressed, nil
+}
+
+// check classifies the risk of a pod or pod template.
+func (w *WorkloadRisk) check(meta *metav1.ObjectMeta, spec *corev1.PodSpec) {
+	if spec.HostNetwork {
+		w.add(RiskLow, "uses host network, not managed by cilium")
+	}
+
+	for _, c := range append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...) {
+		for _, port := range c.Ports {
+			if port.HostPort != 0 && !spec.HostNetwork {
+				w.add(RiskMedium, "uses host ports, which require cilium hostPort support")
+				break
+			}
+		}
+
+		for _, resources := range []corev1.ResourceList{c.Resources.Requests, c.Resources.Limits} {
+			if _, ok := resources[podENIResource]; ok {
+				w.add(RiskHigh, "requests a branch ENI (security groups for pods)")
+			}
+		}
+	}
+
+	if _, ok := meta.Annotations[podENIAnnotation]; ok {
+		w.add(RiskHigh, "has a branch ENI (security groups for pods)")
+	}
+
+	for key := range meta.Annotations {
+		if strings.EqualFold(key, defaultENIConfigKey) {
+			w.add(RiskHigh, "selects an eniConfig with "+key)
+		}
+
+		for _, static := range staticIPAnnotations {
+			if key == static {
+				w.add(RiskHigh, "requests static IPs with "+key)
+			}
+		}
+	}
+}
+
+func (w *WorkloadRisk) add(risk Risk, reason string) {
+	if risk > w.Risk {
+		w.Risk = risk
+	}
+	if !hasString(w.Reasons, reason) {
+		w.Reasons = append(w.Reasons, reason)
+	}
+}
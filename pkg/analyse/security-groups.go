@@ -0,0 +1,198 @@
+package analyse
+
+import (
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	SecurityGroupPolicyGVR = schema.GroupVersionResource{
+		Group:    "vpcresources.k8s.aws",
+		Version:  "v1beta1",
+		Resource: "securitygrouppolicies",
+	}
+)
+
+// SecurityGroupPolicy is a SecurityGroupPolicy and the pods it selects.
+type SecurityGroupPolicy struct {
+	Namespace      string
+	Name           string
+	SecurityGroups []string
+
+	// Pods are the selected pods, as namespace/name.
+	Pods []string
+	// Workloads are the controllers of the selected pods, as
+	// namespace/kind/name.
+	Workloads []string
+}
+
+// securityGroupPolicySpec is the subset of the SecurityGroupPolicy spec used
+// to select pods.
+type securityGroupPolicySpec struct {
+	PodSelector            *metav1.LabelSelector `json:"podSelector"`
+	ServiceAccountSelector *metav1.LabelSelector `json:"serviceAccountSelector"`
+	SecurityGroups         struct {
+		GroupIDs []string `json:"groupIds"`
+	} `json:"securityGroups"`
+}
+
+// SecurityGroupPolicies lists the SecurityGroupPolicies of the VPC resource
+// controller and resolves the pods they select. Pods selected by these get
+// their own branch ENI and security groups, which are lost under Cilium.
+func (a *Analyser) SecurityGroupPolicies() ([]SecurityGroupPolicy, error) {
+	list, err := a.dynamicClient.Resource(SecurityGroupPolicyGVR).List(a.ctx, metav1.ListOptions{})
+	if apierrors.IsNotFound(err) {
+		a.log.Debug("securitygrouppolicies are not installed in the cluster")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list securitygrouppolicies: %s", err)
+	}
+
+	var policies []SecurityGroupPolicy
+	owners := make(map[string]string)
+	for _, item := range list.Items {
+		policy, err := a.securityGroupPolicy(item, owners)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+
+	return policies, nil
+}
+
+func (a *Analyser) securityGroupPolicy(item unstructured.Unstructured, owners map[string]string) (SecurityGroupPolicy, error) {
+	policy := SecurityGroupPolicy{
+		Namespace: item.GetNamespace(),
+		Name:      item.GetName(),
+	}
+
+	var spec securityGroupPolicySpec
+	if raw, ok := item.Object["spec"].(map[string]interface{}); ok {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &spec); err != nil {
+			return policy, fmt.Errorf("failed to parse securitygrouppolicy %s/%s: %s", policy.Namespace, policy.Name, err)
+		}
+	}
+	policy.SecurityGroups = spec.SecurityGroups.GroupIDs
+
+	// A policy without selectors selects nothing.
+	if spec.PodSelector == nil && spec.ServiceAccountSelector == nil {
+		return policy, nil
+	}
+
+	podSelector, err := selector(spec.PodSelector)
+	if err != nil {
+		return policy, fmt.Errorf("securitygrouppolicy %s/%s: invalid podSelector: %s", policy.Namespace, policy.Name, err)
+	}
+
+	saSelector, err := selector(spec.ServiceAccountSelector)
+	if err != nil {
+		return policy, fmt.Errorf("securitygrouppolicy %s/%s: invalid serviceAccountSelector: %s", policy.Namespace, policy.Name, err)
+	}
+
+	pods, err := a.client.CoreV1().Pods(policy.Namespace).List(a.ctx, metav1.ListOptions{
+		LabelSelector: podSelector.String(),
+	})
+	if err != nil {
+		return policy, err
+	}
+
+	serviceAccounts := make(map[string]bool)
+	if spec.ServiceAccountSelector != nil {
+		sas, err := a.client.CoreV1().ServiceAccounts(policy.Namespace).List(a.ctx, metav1.ListOptions{
+			LabelSelector: saSelector.String(),
+		})
+		if err != nil {
+			return policy, err
+		}
+		for _, sa := range sas.Items {
+			serviceAccounts[sa.Name] = true
+		}
+	}
+
+	workloads := make(map[string]bool)
+	for _, pod := range pods.Items {
+		if spec.ServiceAccountSelector != nil && !serviceAccounts[podServiceAccount(&pod)] {
+			continue
+		}
+
+		policy.Pods = append(policy.Pods, pod.Namespace+"/"+pod.Name)
+
+		workload, err := a.podWorkload(&pod, owners)
+		if err != nil {
+			return policy, err
+		}
+		workloads[workload] = true
+	}
+
+	for workload := range workloads {
+		policy.Workloads = append(policy.Workloads, workload)
+	}
+	sort.Strings(policy.Pods)
+	sort.Strings(policy.Workloads)
+
+	return policy, nil
+}
+
+// podWorkload returns the top level controller of a pod as
+// namespace/kind/name, following ReplicaSets to their Deployment and Jobs to
+// their CronJob. Resolved controllers are cached in owners, so pods of the
+// same ReplicaSet or Job are resolved with a single request.
+func (a *Analyser) podWorkload(pod *corev1.Pod, owners map[string]string) (string, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return pod.Namespace + "/Pod/" + pod.Name, nil
+	}
+
+	key := pod.Namespace + "/" + owner.Kind + "/" + owner.Name
+	if workload, ok := owners[key]; ok {
+		return workload, nil
+	}
+
+	var parent metav1.Object
+	var err error
+
+	switch owner.Kind {
+	case "ReplicaSet":
+		parent, err = a.client.AppsV1().ReplicaSets(pod.Namespace).Get(a.ctx, owner.Name, metav1.GetOptions{})
+	case "Job":
+		parent, err = a.client.BatchV1().Jobs(pod.Namespace).Get(a.ctx, owner.Name, metav1.GetOptions{})
+	}
+
+	if err != nil && !apierrors.IsNotFound(err) {
+		return "", err
+	}
+	if err == nil && parent != nil {
+		if parentOwner := metav1.GetControllerOf(parent); parentOwner != nil {
+			owner = parentOwner
+		}
+	}
+
+	owners[key] = pod.Namespace + "/" + owner.Kind + "/" + owner.Name
+
+	return owners[key], nil
+}
+
+// selector converts a label selector, where nil selects everything.
+func selector(ls *metav1.LabelSelector) (labels.Selector, error) {
+	if ls == nil {
+		return labels.Everything(), nil
+	}
+	return metav1.LabelSelectorAsSelector(ls)
+}
+
+func podServiceAccount(pod *corev1.Pod) string {
+	if pod.Spec.ServiceAccountName != "" {
+		return pod.Spec.ServiceAccountName
+	}
+	return "default"
+}
@@ -0,0 +1,46 @@
+// Package aws holds the AWS API clients used by the migration. Each client is
+// an interface covering only the calls the migration makes, so it can be
+// replaced with a fake.
+package aws
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// newSession returns an AWS session using the default credential chain, with
+// region and profile overriding the environment if set.
+func newSession(region, profile string) (*session.Session, error) {
+	opts := session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+		Profile:           profile,
+	}
+	if region != "" {
+		opts.Config.Region = aws.String(region)
+	}
+
+	return session.NewSessionWithOptions(opts)
+}
+
+// lazySession creates the AWS session on first use, so commands which make no
+// AWS calls do not need AWS configuration.
+type lazySession struct {
+	region, profile string
+
+	once sync.Once
+	sess *session.Session
+	err  error
+}
+
+func (l *lazySession) get() (*session.Session, error) {
+	l.once.Do(func() {
+		l.sess, l.err = newSession(l.region, l.profile)
+		if l.err != nil {
+			l.err = fmt.Errorf("failed to create aws session: %s", l.err)
+		}
+	})
+	return l.sess, l.err
+}
@@ -0,0 +1,96 @@
+package aws
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Subnet is a VPC subnet and its free IP addresses.
+type Subnet struct {
+	ID               string
+	AvailabilityZone string
+	CIDR             string
+	AvailableIPs     int64
+}
+
+// EC2 is the subset of the EC2 API used by the migration.
+type EC2 interface {
+	// DescribeSubnets returns the subnets with the given IDs.
+	DescribeSubnets(ctx context.Context, ids []string) ([]Subnet, error)
+	// InstanceSubnets returns the subnet of each of the given instances,
+	// keyed by instance ID.
+	InstanceSubnets(ctx context.Context, instanceIDs []string) (map[string]string, error)
+}
+
+type ec2Client struct {
+	session *lazySession
+}
+
+// NewEC2 returns an EC2 client for region using the default credential
+// chain, or profile if set. The session is created on the first call.
+func NewEC2(region, profile string) EC2 {
+	return &ec2Client{session: &lazySession{region: region, profile: profile}}
+}
+
+func (e *ec2Client) client() (*ec2.EC2, error) {
+	sess, err := e.session.get()
+	if err != nil {
+		return nil, err
+	}
+	return ec2.New(sess), nil
+}
+
+func (e *ec2Client) DescribeSubnets(ctx context.Context, ids []string) ([]Subnet, error) {
+	client, err := e.client()
+	if err != nil {
+		return nil, err
+	}
+
+	var subnets []Subnet
+
+	err = client.DescribeSubnetsPagesWithContext(ctx, &ec2.DescribeSubnetsInput{
+		SubnetIds: aws.StringSlice(ids),
+	}, func(page *ec2.DescribeSubnetsOutput, _ bool) bool {
+		for _, s := range page.Subnets {
+			subnets = append(subnets, Subnet{
+				ID:               aws.StringValue(s.SubnetId),
+				AvailabilityZone: aws.StringValue(s.AvailabilityZone),
+				CIDR:             aws.StringValue(s.CidrBlock),
+				AvailableIPs:     aws.Int64Value(s.AvailableIpAddressCount),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return subnets, nil
+}
+
+func (e *ec2Client) InstanceSubnets(ctx context.Context, instanceIDs []string) (map[string]string, error) {
+	client, err := e.client()
+	if err != nil {
+		return nil, err
+	}
+
+	subnets := make(map[string]string)
+
+	err = client.DescribeInstancesPagesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice(instanceIDs),
+	}, func(page *ec2.DescribeInstancesOutput, _ bool) bool {
+		for _, r := range page.Reservations {
+			for _, i := range r.Instances {
+				subnets[aws.StringValue(i.InstanceId)] = aws.StringValue(i.SubnetId)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return subnets, nil
+}
@@ -0,0 +1,161 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/eks"
+)
+
+// Addon is an EKS managed add-on.
+type Addon struct {
+	Name    string
+	Version string
+	Status  string
+}
+
+// Cluster is an EKS cluster.
+type Cluster struct {
+	Name string
+	// Version is the Kubernetes minor version, e.g. 1.24.
+	Version string
+	// PlatformVersion is the EKS platform version of the Kubernetes
+	// version, e.g. eks.5.
+	PlatformVersion string
+	Status          string
+}
+
+// EKS is the subset of the EKS API used by the migration.
+type EKS interface {
+	// DescribeCluster returns a cluster.
+	DescribeCluster(ctx context.Context, cluster string) (*Cluster, error)
+	// DescribeAddon returns the add-on of a cluster, or nil if it is not
+	// installed.
+	DescribeAddon(ctx context.Context, cluster, name string) (*Addon, error)
+	// DeleteAddon removes the add-on from a cluster. If preserve is true,
+	// EKS stops managing the add-on but leaves its resources in the cluster.
+	DeleteAddon(ctx context.Context, cluster, name string, preserve bool) error
+	// ScaleNodegroup sets the minimum and desired size of a managed node
+	// group to size.
+	ScaleNodegroup(ctx context.Context, cluster, nodegroup string, size int64) error
+}
+
+type eksClient struct {
+	session *lazySession
+}
+
+// NewEKS returns an EKS client for region using the default credential
+// chain, or profile if set. The session is created on the first call.
+func NewEKS(region, profile string) EKS {
+	return &eksClient{session: &lazySession{region: region, profile: profile}}
+}
+
+func (e *eksClient) client() (*eks.EKS, error) {
+	sess, err := e.session.get()
+	if err != nil {
+		return nil, err
+	}
+	return eks.New(sess), nil
+}
+
+func (e *eksClient) DescribeCluster(ctx context.Context, cluster string) (*Cluster, error) {
+	client, err := e.client()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := client.DescribeClusterWithContext(ctx, &eks.DescribeClusterInput{
+		Name: aws.String(cluster),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cluster{
+		Name:            aws.StringValue(out.Cluster.Name),
+		Version:         aws.StringValue(out.Cluster.Version),
+		PlatformVersion: aws.StringValue(out.Cluster.PlatformVersion),
+		Status:          aws.StringValue(out.Cluster.Status),
+	}, nil
+}
+
+func (e *eksClient) DescribeAddon(ctx context.Context, cluster, name string) (*Addon, error) {
+	client, err := e.client()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := client.DescribeAddonWithContext(ctx, &eks.DescribeAddonInput{
+		ClusterName: aws.String(cluster),
+		AddonName:   aws.String(name),
+	})
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Addon{
+		Name:    aws.StringValue(out.Addon.AddonName),
+		Version: aws.StringValue(out.Addon.AddonVersion),
+		Status:  aws.StringValue(out.Addon.Status),
+	}, nil
+}
+
+func (e *eksClient) DeleteAddon(ctx context.Context, cluster, name string, preserve bool) error {
+	client, err := e.client()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.DeleteAddonWithContext(ctx, &eks.DeleteAddonInput{
+		ClusterName: aws.String(cluster),
+		AddonName:   aws.String(name),
+		Preserve:    aws.Bool(preserve),
+	})
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (e *eksClient) ScaleNodegroup(ctx context.Context, cluster, nodegroup string, size int64) error {
+	client, err := e.client()
+	if err != nil {
+		return err
+	}
+
+	out, err := client.DescribeNodegroupWithContext(ctx, &eks.DescribeNodegroupInput{
+		ClusterName:   aws.String(cluster),
+		NodegroupName: aws.String(nodegroup),
+	})
+	if err != nil {
+		return err
+	}
+
+	// The maximum size must be set with the other sizes, and is kept.
+	scaling := out.Nodegroup.ScalingConfig
+	if scaling == nil || aws.Int64Value(scaling.MaxSize) < size {
+		return fmt.Errorf("node group %s maximum size is smaller than %d", nodegroup, size)
+	}
+
+	_, err = client.UpdateNodegroupConfigWithContext(ctx, &eks.UpdateNodegroupConfigInput{
+		ClusterName:   aws.String(cluster),
+		NodegroupName: aws.String(nodegroup),
+		ScalingConfig: &eks.NodegroupScalingConfig{
+			MinSize:     aws.Int64(size),
+			DesiredSize: aws.Int64(size),
+			MaxSize:     scaling.MaxSize,
+		},
+	})
+	return err
+}
+
+func isNotFound(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == eks.ErrCodeResourceNotFoundException
+}
@@ -0,0 +1,89 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+)
+
+var _ EC2 = &FakeEC2{}
+
+// FakeEC2 serves subnets and instances from memory. It is intended to be used
+// in tests, or to run the migration against a local cluster, in place of EC2.
+type FakeEC2 struct {
+	Subnets map[string]Subnet
+	// Instances maps instance IDs to their subnet ID.
+	Instances map[string]string
+}
+
+func (f *FakeEC2) DescribeSubnets(_ context.Context, ids []string) ([]Subnet, error) {
+	var subnets []Subnet
+	for _, id := range ids {
+		s, ok := f.Subnets[id]
+		if !ok {
+			return nil, fmt.Errorf("subnet %s not found", id)
+		}
+		subnets = append(subnets, s)
+	}
+	return subnets, nil
+}
+
+func (f *FakeEC2) InstanceSubnets(_ context.Context, instanceIDs []string) (map[string]string, error) {
+	subnets := make(map[string]string)
+	for _, id := range instanceIDs {
+		if subnet, ok := f.Instances[id]; ok {
+			subnets[id] = subnet
+		}
+	}
+	return subnets, nil
+}
+
+var _ EKS = &FakeEKS{}
+
+// FakeEKS serves clusters, add-ons and node group sizes from memory, add-ons
+// and node groups keyed by cluster and name as "cluster/name". Deleted
+// add-ons are recorded with whether their resources were preserved.
+type FakeEKS struct {
+	Clusters map[string]*Cluster
+	Addons   map[string]*Addon
+	// Deleted maps deleted add-ons to the preserve option they were deleted
+	// with.
+	Deleted map[string]bool
+	// Nodegroups maps node groups to their desired size.
+	Nodegroups map[string]int64
+}
+
+func (f *FakeEKS) DescribeCluster(_ context.Context, cluster string) (*Cluster, error) {
+	c, ok := f.Clusters[cluster]
+	if !ok {
+		return nil, fmt.Errorf("cluster %s not found", cluster)
+	}
+	return c, nil
+}
+
+func (f *FakeEKS) DescribeAddon(_ context.Context, cluster, name string) (*Addon, error) {
+	return f.Addons[cluster+"/"+name], nil
+}
+
+func (f *FakeEKS) DeleteAddon(_ context.Context, cluster, name string, preserve bool) error {
+	key := cluster + "/" + name
+	if _, ok := f.Addons[key]; !ok {
+		return nil
+	}
+	delete(f.Addons, key)
+
+	if f.Deleted == nil {
+		f.Deleted = make(map[string]bool)
+	}
+	f.Deleted[key] = preserve
+
+	return nil
+}
+
+func (f *FakeEKS) ScaleNodegroup(_ context.Context, cluster, nodegroup string, size int64) error {
+	key := cluster + "/" + nodegroup
+	if _, ok := f.Nodegroups[key]; !ok {
+		return fmt.Errorf("node group %s not found", nodegroup)
+	}
+	f.Nodegroups[key] = size
+	return nil
+}
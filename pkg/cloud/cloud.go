@@ -0,0 +1,55 @@
+// Package cloud scales down the node groups of the cloud provider the cluster
+// runs on. Providers implement NodeGroups, and are selected by name.
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/brnck/cni-migration/pkg/aws"
+	"github.com/brnck/cni-migration/pkg/config"
+)
+
+// Supported node group providers.
+const (
+	ProviderEKS = "eks"
+)
+
+// NodeGroups scales the node groups of a cloud provider.
+type NodeGroups interface {
+	// NodeGroup returns the node group of a node, or "" if it is not part of
+	// a node group of the provider.
+	NodeGroup(node *corev1.Node) string
+	// ScaleDown scales a node group to zero nodes.
+	ScaleDown(ctx context.Context, name string) error
+}
+
+// New returns the node groups of provider.
+func New(provider string, config *config.Config) (NodeGroups, error) {
+	switch provider {
+	case ProviderEKS:
+		if config.AWS.ClusterName == "" {
+			return nil, errors.New("aws.cluster-name is required to scale eks node groups")
+		}
+		return &eksNodeGroups{eks: config.EKS, cluster: config.AWS.ClusterName}, nil
+	default:
+		return nil, fmt.Errorf("unknown node group provider %q, expected %s", provider, ProviderEKS)
+	}
+}
+
+// eksNodeGroups are EKS managed node groups.
+type eksNodeGroups struct {
+	eks     aws.EKS
+	cluster string
+}
+
+func (e *eksNodeGroups) NodeGroup(node *corev1.Node) string {
+	return node.Labels["eks.amazonaws.com/nodegroup"]
+}
+
+func (e *eksNodeGroups) ScaleDown(ctx context.Context, name string) error {
+	return e.eks.ScaleNodegroup(ctx, e.cluster, name, 0)
+}
@@ -4,11 +4,16 @@ import (
 	"fmt"
 	helmclient "github.com/mittwald/go-helm-client"
 	"io/ioutil"
+	"path"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+
+	"github.com/brnck/cni-migration/pkg/aws"
 )
 
 type Labels struct {
@@ -19,6 +24,8 @@ type Labels struct {
 }
 
 type Paths struct {
+	// KnetStress is an optional knet-stress manifest template, overriding
+	// the one embedded in the binary.
 	KnetStress          string `yaml:"knet-stress"`
 	CiliumPreMigration  string `yaml:"cilium-pre-migration"`
 	CiliumPostMigration string `yaml:"cilium-post-migration"`
@@ -27,6 +34,20 @@ type Paths struct {
 type AwsVpcCni struct {
 	Namespace     string `yaml:"namespace"`
 	DaemonsetName string `yaml:"daemonsetName"`
+	ConfigMapName string `yaml:"configMapName"`
+
+	// BackupPath and BackupSecret are the local file and the Secret in
+	// Namespace aws-node is backed up to before it is deleted.
+	BackupPath   string `yaml:"backupPath"`
+	BackupSecret string `yaml:"backupSecret"`
+
+	// AddonName is the name of the EKS managed add-on aws-node is installed
+	// with, if any.
+	AddonName string `yaml:"addonName"`
+
+	// ForceDelete deletes aws-node even if pods on AWS VPC CNI nodes still
+	// use it.
+	ForceDelete bool `yaml:"forceDelete"`
 }
 
 type ClusterAutoscaler struct {
@@ -37,10 +58,231 @@ type ClusterAutoscaler struct {
 
 type Cilium struct {
 	ReleaseName string `yaml:"release-name"`
-	ChartName   string `yaml:"chart-name"`
-	RepoPath    string `yaml:"repo-path"`
-	Version     string `yaml:"version"`
-	Namespace   string `yaml:"namespace"`
+	// ChartName is either a "<repo>/<chart>" reference, a local chart
+	// directory or archive, or an oci:// reference.
+	ChartName string `yaml:"chart-name"`
+	// RepoPath is the repository added for "<repo>/<chart>" references. It
+	// is not used for local or OCI charts, and may be empty if the
+	// repository is already present in the Helm repository config.
+	RepoPath  string `yaml:"repo-path"`
+	Version   string `yaml:"version"`
+	Namespace string `yaml:"namespace"`
+
+	// ChartSHA256 is the expected sha256 checksum of the chart archive.
+	ChartSHA256 string `yaml:"chart-sha256"`
+	// Verify verifies the chart provenance file against Keyring.
+	Verify  bool   `yaml:"verify"`
+	Keyring string `yaml:"keyring"`
+
+	// RestartUnmanagedPods will delete pods running on Cilium nodes which
+	// are not managed by Cilium, so they are re-created with Cilium networking.
+	RestartUnmanagedPods bool `yaml:"restart-unmanaged-pods"`
+
+	// HealthTimeout is how long to wait for Cilium agents and nodes to become
+	// healthy after a deploy or update.
+	HealthTimeout time.Duration `yaml:"health-timeout"`
+
+	// ConvergenceTimeout is how long to wait for CiliumEndpoints and
+	// CiliumIdentities to converge after an update.
+	ConvergenceTimeout time.Duration `yaml:"convergence-timeout"`
+
+	// Values are additional values files and overrides for each phase,
+	// merged over the paths values files.
+	Values *CiliumValues `yaml:"values"`
+
+	// SetOverrides are the --set overrides given on the command line.
+	SetOverrides []string `yaml:"-"`
+}
+
+type CiliumValues struct {
+	PreMigration  *ValuesLayers `yaml:"pre-migration"`
+	PostMigration *ValuesLayers `yaml:"post-migration"`
+}
+
+type ValuesLayers struct {
+	Files []string `yaml:"files"`
+	Set   []string `yaml:"set"`
+}
+
+type Preflight struct {
+	// StrictCompatibility fails preflight when the cluster is not compatible
+	// with the Cilium version, instead of only warning.
+	StrictCompatibility bool `yaml:"strict-compatibility"`
+
+	// AcknowledgeSecurityGroupPolicies allows the migration to continue when
+	// pods are selected by SecurityGroupPolicies, and so lose their security
+	// groups under Cilium.
+	AcknowledgeSecurityGroupPolicies bool `yaml:"acknowledge-security-group-policies"`
+
+	// AcknowledgeNetworkPolicies allows the migration to continue when
+	// policies cannot be translated to Cilium, such as Calico specific
+	// policies.
+	AcknowledgeNetworkPolicies bool `yaml:"acknowledge-network-policies"`
+
+	// AcknowledgeMaxPods allows the migration to continue when Cilium
+	// labelled nodes admit more pods than Cilium can allocate ENI IPs for.
+	AcknowledgeMaxPods bool `yaml:"acknowledge-max-pods"`
+
+	SubnetCapacity *SubnetCapacity `yaml:"subnet-capacity"`
+
+	// CiliumCapacity fails preflight when the Cilium labelled nodes cannot
+	// absorb the workloads of the AWS VPC CNI nodes.
+	CiliumCapacity bool `yaml:"cilium-capacity"`
+}
+
+// SubnetCapacity configures the check that the VPC subnets have enough free
+// IPs for aws-node and Cilium to allocate from them side by side.
+type SubnetCapacity struct {
+	Enabled bool `yaml:"enabled"`
+	// SubnetIDs are the subnets pods draw IPs from in their availability
+	// zone. Defaults to the subnets of the ENIConfigs, or of each node.
+	SubnetIDs []string `yaml:"subnet-ids"`
+	// NewNodes is the number of Cilium nodes created during the migration.
+	// Defaults to the number of nodes in the cluster.
+	NewNodes int `yaml:"new-nodes"`
+	// PreAllocate is the number of IPs Cilium pre-allocates on each node.
+	PreAllocate int `yaml:"pre-allocate"`
+	// WarnRatio is the share of free IPs the demand may use before a warning
+	// is logged.
+	WarnRatio float64 `yaml:"warn-ratio"`
+}
+
+// AWS configures the AWS API clients. The default credential chain is used.
+type AWS struct {
+	Region  string `yaml:"region"`
+	Profile string `yaml:"profile"`
+	// ClusterName is the EKS cluster name, required to manage add-ons and
+	// to check the EKS platform version.
+	ClusterName string `yaml:"cluster-name"`
+}
+
+type Helm struct {
+	RepositoryConfig string `yaml:"repository-config"`
+	RepositoryCache  string `yaml:"repository-cache"`
+	RegistryConfig   string `yaml:"registry-config"`
+}
+
+type KnetStress struct {
+	// Name is used for the knet-stress Service, ServiceAccount, RBAC and
+	// the app label selecting all knet-stress pods.
+	Name        string                `yaml:"name"`
+	Namespace   string                `yaml:"namespace"`
+	Image       string                `yaml:"image"`
+	DaemonSets  []KnetStressDaemonSet `yaml:"daemonsets"`
+	Tolerations []Toleration          `yaml:"tolerations"`
+	Resources   *ResourceRequirements `yaml:"resources"`
+}
+
+type KnetStressDaemonSet struct {
+	Name string `yaml:"name"`
+	// NodeLabel schedules the DaemonSet only to nodes with the given
+	// migration label, either "aws-vpc-cni" or "cilium". When empty, the
+	// DaemonSet is scheduled to all nodes.
+	NodeLabel string `yaml:"node-label"`
+}
+
+type Toleration struct {
+	Key      string `yaml:"key" json:"key,omitempty"`
+	Operator string `yaml:"operator" json:"operator,omitempty"`
+	Value    string `yaml:"value" json:"value,omitempty"`
+	Effect   string `yaml:"effect" json:"effect,omitempty"`
+}
+
+type ResourceRequirements struct {
+	Requests map[string]string `yaml:"requests" json:"requests,omitempty"`
+	Limits   map[string]string `yaml:"limits" json:"limits,omitempty"`
+}
+
+type Hubble struct {
+	// Enabled observes dropped flows through Hubble Relay during live steps.
+	Enabled bool `yaml:"enabled"`
+
+	RelayAddress string `yaml:"relay-address"`
+	// PortForward starts a kubectl port-forward from RelayAddress to the
+	// relay service while observing.
+	PortForward  bool   `yaml:"port-forward"`
+	RelayService string `yaml:"relay-service"`
+	RelayPort    int    `yaml:"relay-port"`
+
+	// DropThreshold is the number of dropped flows a step may cause before
+	// it is reported, or failed if FailOnDrops is set.
+	DropThreshold int  `yaml:"drop-threshold"`
+	FailOnDrops   bool `yaml:"fail-on-drops"`
+}
+
+// KubeProxyReplacement configures the optional post-migration step which
+// enables Cilium's kube-proxy replacement and removes kube-proxy.
+type KubeProxyReplacement struct {
+	Enabled bool `yaml:"enabled"`
+
+	// K8sServiceHost and K8sServicePort are the API server endpoint Cilium
+	// connects to without the kubernetes service. Defaults to the API server
+	// of the current kube config.
+	K8sServiceHost string `yaml:"k8s-service-host"`
+	K8sServicePort int    `yaml:"k8s-service-port"`
+
+	Namespace     string `yaml:"namespace"`
+	DaemonSetName string `yaml:"daemonset-name"`
+	// BackupPath is the file the kube-proxy DaemonSet is backed up to before
+	// it is removed.
+	BackupPath string `yaml:"backup-path"`
+	// KeepOnFailure leaves kube-proxy removed and kube-proxy replacement
+	// enabled if the checks fail, instead of reverting.
+	KeepOnFailure bool `yaml:"keep-on-failure"`
+}
+
+// Decommission configures the step between pre-migration and post-migration,
+// which drains the AWS VPC CNI nodes and optionally scales down their node
+// groups.
+type Decommission struct {
+	// Concurrency is the number of nodes drained at the same time.
+	Concurrency int `yaml:"concurrency"`
+	// DrainTimeout is how long to wait for a node to drain.
+	DrainTimeout time.Duration `yaml:"drain-timeout"`
+	// DeleteEmptyDirData evicts pods using emptyDir volumes, whose data is
+	// lost.
+	DeleteEmptyDirData bool `yaml:"delete-emptydir-data"`
+
+	// NodeGroupProvider scales the node groups of the drained nodes down to
+	// zero if set. Only "eks" managed node groups are supported.
+	NodeGroupProvider string `yaml:"node-group-provider"`
+	// ScaleDownTimeout is how long to wait for the nodes to be removed after
+	// their node groups are scaled down.
+	ScaleDownTimeout time.Duration `yaml:"scale-down-timeout"`
+}
+
+// NodeCleanup configures the optional post-migration step which removes the
+// CNI configuration, iptables chains and IPAM state aws-node leaves on nodes.
+type NodeCleanup struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Namespace the cleanup jobs run in.
+	Namespace string `yaml:"namespace"`
+	// Image runs the cleanup script, and must provide sh and iptables.
+	Image string `yaml:"image"`
+	// Timeout is how long to wait for the cleanup of all nodes.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// NodeLabeller configures labelling nodes which join during the migration
+// without a migration label, so they are not left without a CNI.
+type NodeLabeller struct {
+	Enabled bool `yaml:"enabled"`
+
+	// NodeGroupLabel is the node label holding the node group name.
+	NodeGroupLabel string `yaml:"node-group-label"`
+	// Rules select the migration label of a node by its node group. The
+	// first matching rule applies.
+	Rules []NodeLabelRule `yaml:"rules"`
+}
+
+type NodeLabelRule struct {
+	// NodeGroup is a node group name, or a path.Match pattern such as
+	// "cilium-*". "*" also matches nodes without a node group.
+	NodeGroup string `yaml:"node-group"`
+	// Label is the migration label applied, either "aws-vpc-cni" or
+	// "cilium".
+	Label string `yaml:"label"`
 }
 
 type Resources struct {
@@ -55,13 +297,26 @@ type Config struct {
 	*AwsVpcCni         `yaml:"awsVpcCni"`
 	*ClusterAutoscaler `yaml:"clusterAutoscaler"`
 	*Cilium            `yaml:"cilium"`
-	PreflightResources *Resources `yaml:"preflightResources"`
-	WatchedResources   *Resources `yaml:"watchedResources"`
-	CleanUpResources   *Resources `yaml:"cleanUpResources"`
+	Helm               *Helm       `yaml:"helm"`
+	Preflight          *Preflight  `yaml:"preflight"`
+	PreflightResources *Resources  `yaml:"preflightResources"`
+	WatchedResources   *Resources  `yaml:"watchedResources"`
+	CleanUpResources   *Resources  `yaml:"cleanUpResources"`
+	KnetStress         *KnetStress `yaml:"knetStress"`
+	Hubble             *Hubble     `yaml:"hubble"`
+
+	KubeProxyReplacement *KubeProxyReplacement `yaml:"kubeProxyReplacement"`
+	NodeCleanup          *NodeCleanup          `yaml:"nodeCleanup"`
+	NodeLabeller         *NodeLabeller         `yaml:"nodeLabeller"`
+	Decommission         *Decommission         `yaml:"decommission"`
+	AWS                  *AWS                  `yaml:"aws"`
 
-	Client     *kubernetes.Clientset
-	HelmClient helmclient.Client
-	Log        *logrus.Entry
+	Client        *kubernetes.Clientset
+	DynamicClient dynamic.Interface
+	HelmClient    helmclient.Client
+	EC2           aws.EC2
+	EKS           aws.EKS
+	Log           *logrus.Entry
 }
 
 func New(configPath string, logLevel logrus.Level, kubeFactory cmdutil.Factory) (*Config, error) {
@@ -77,18 +332,32 @@ func New(configPath string, logLevel logrus.Level, kubeFactory cmdutil.Factory)
 			configPath, err)
 	}
 
+	if err := config.setDefaults(); err != nil {
+		return nil, fmt.Errorf("invalid config %q: %s", configPath, err)
+	}
+
 	config.Client, err = kubeFactory.KubernetesClientSet()
 	if err != nil {
 		return nil, fmt.Errorf("failed to build kubernetes client: %s", err)
 	}
 
+	config.DynamicClient, err = kubeFactory.DynamicClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build kubernetes dynamic client: %s", err)
+	}
+
+	config.EC2 = aws.NewEC2(config.AWS.Region, config.AWS.Profile)
+
+	config.EKS = aws.NewEKS(config.AWS.Region, config.AWS.Profile)
+
 	logger := logrus.New()
 	logger.SetLevel(logLevel)
 	config.Log = logrus.NewEntry(logger)
 
 	hc, err := helmclient.New(&helmclient.Options{
-		RepositoryConfig: "/tmp/.helmrepo",
-		RepositoryCache:  "/tmp/.helmcache",
+		RepositoryConfig: config.Helm.RepositoryConfig,
+		RepositoryCache:  config.Helm.RepositoryCache,
+		RegistryConfig:   config.Helm.RegistryConfig,
 		Debug:            false,
 		Linting:          false,
 		Namespace:        config.Cilium.Namespace,
@@ -100,3 +369,187 @@ func New(configPath string, logLevel logrus.Level, kubeFactory cmdutil.Factory)
 
 	return config, nil
 }
+
+// setDefaults populates optional config sections, and adds the knet-stress
+// DaemonSets to the preflight, watched and clean up resources so all steps
+// derive them from the same settings.
+func (c *Config) setDefaults() error {
+	if c.AwsVpcCni == nil {
+		c.AwsVpcCni = new(AwsVpcCni)
+	}
+	if c.AwsVpcCni.Namespace == "" {
+		c.AwsVpcCni.Namespace = "kube-system"
+	}
+	if c.AwsVpcCni.DaemonsetName == "" {
+		c.AwsVpcCni.DaemonsetName = "aws-node"
+	}
+	if c.AwsVpcCni.ConfigMapName == "" {
+		c.AwsVpcCni.ConfigMapName = "amazon-vpc-cni"
+	}
+	if c.AwsVpcCni.BackupPath == "" {
+		c.AwsVpcCni.BackupPath = "aws-node-backup.yaml"
+	}
+	if c.AwsVpcCni.BackupSecret == "" {
+		c.AwsVpcCni.BackupSecret = "aws-node-backup"
+	}
+	if c.AwsVpcCni.AddonName == "" {
+		c.AwsVpcCni.AddonName = "vpc-cni"
+	}
+
+	if c.Cilium.Values == nil {
+		c.Cilium.Values = new(CiliumValues)
+	}
+
+	if c.Preflight == nil {
+		c.Preflight = new(Preflight)
+	}
+	if c.Preflight.SubnetCapacity == nil {
+		c.Preflight.SubnetCapacity = new(SubnetCapacity)
+	}
+	if c.Preflight.SubnetCapacity.PreAllocate == 0 {
+		// The Cilium ENI IPAM default.
+		c.Preflight.SubnetCapacity.PreAllocate = 8
+	}
+	if c.Preflight.SubnetCapacity.WarnRatio == 0 {
+		c.Preflight.SubnetCapacity.WarnRatio = 0.8
+	}
+
+	if c.AWS == nil {
+		c.AWS = new(AWS)
+	}
+
+	if c.Helm == nil {
+		c.Helm = new(Helm)
+	}
+	if c.Helm.RepositoryConfig == "" {
+		c.Helm.RepositoryConfig = "/tmp/.helmrepo"
+	}
+	if c.Helm.RepositoryCache == "" {
+		c.Helm.RepositoryCache = "/tmp/.helmcache"
+	}
+
+	if c.Hubble == nil {
+		c.Hubble = new(Hubble)
+	}
+
+	if c.KubeProxyReplacement == nil {
+		c.KubeProxyReplacement = new(KubeProxyReplacement)
+	}
+	kpr := c.KubeProxyReplacement
+	if kpr.Namespace == "" {
+		kpr.Namespace = "kube-system"
+	}
+	if kpr.DaemonSetName == "" {
+		kpr.DaemonSetName = "kube-proxy"
+	}
+	if kpr.BackupPath == "" {
+		kpr.BackupPath = "kube-proxy-backup.yaml"
+	}
+
+	if c.Decommission == nil {
+		c.Decommission = new(Decommission)
+	}
+	dc := c.Decommission
+	if dc.Concurrency == 0 {
+		dc.Concurrency = 1
+	}
+	if dc.DrainTimeout == 0 {
+		dc.DrainTimeout = 15 * time.Minute
+	}
+	if dc.ScaleDownTimeout == 0 {
+		dc.ScaleDownTimeout = 20 * time.Minute
+	}
+
+	if c.NodeCleanup == nil {
+		c.NodeCleanup = new(NodeCleanup)
+	}
+	nc := c.NodeCleanup
+	if nc.Namespace == "" {
+		nc.Namespace = "kube-system"
+	}
+	if nc.Image == "" {
+		nc.Image = "registry.k8s.io/build-image/debian-iptables:bookworm-v1.0.0"
+	}
+	if nc.Timeout == 0 {
+		nc.Timeout = 10 * time.Minute
+	}
+
+	if c.NodeLabeller == nil {
+		c.NodeLabeller = new(NodeLabeller)
+	}
+	nl := c.NodeLabeller
+	if nl.NodeGroupLabel == "" {
+		nl.NodeGroupLabel = "eks.amazonaws.com/nodegroup"
+	}
+	for _, rule := range nl.Rules {
+		switch rule.Label {
+		case "aws-vpc-cni", "cilium":
+		default:
+			return fmt.Errorf("node labeller rule %q has unknown label %q, must be one of aws-vpc-cni, cilium",
+				rule.NodeGroup, rule.Label)
+		}
+		if _, err := path.Match(rule.NodeGroup, ""); err != nil {
+			return fmt.Errorf("node labeller rule %q has an invalid node-group pattern: %s", rule.NodeGroup, err)
+		}
+	}
+
+	if c.KnetStress == nil {
+		c.KnetStress = new(KnetStress)
+	}
+	ks := c.KnetStress
+	if ks.Name == "" {
+		ks.Name = "knet-stress"
+	}
+	if ks.Namespace == "" {
+		ks.Namespace = "knet-stress"
+	}
+	if ks.Image == "" {
+		ks.Image = "brnck/knet-stress"
+	}
+	if len(ks.DaemonSets) == 0 {
+		ks.DaemonSets = []KnetStressDaemonSet{{Name: "knet-stress"}, {Name: "knet-stress-2"}}
+	}
+	if ks.Tolerations == nil {
+		ks.Tolerations = []Toleration{
+			{Effect: "NoSchedule", Operator: "Exists"},
+			{Key: "CriticalAddonsOnly", Operator: "Exists"},
+			{Effect: "NoExecute", Operator: "Exists"},
+			{Effect: "NoExecute", Key: c.Labels.Cilium},
+		}
+	}
+
+	for _, ds := range ks.DaemonSets {
+		switch ds.NodeLabel {
+		case "", "aws-vpc-cni", "cilium":
+		default:
+			return fmt.Errorf("knet-stress daemonset %q has unknown node-label %q, must be one of aws-vpc-cni, cilium",
+				ds.Name, ds.NodeLabel)
+		}
+	}
+
+	for _, resources := range []**Resources{&c.PreflightResources, &c.WatchedResources, &c.CleanUpResources} {
+		if *resources == nil {
+			*resources = new(Resources)
+		}
+		if (*resources).DaemonSets == nil {
+			(*resources).DaemonSets = make(map[string][]string)
+		}
+
+		for _, ds := range ks.DaemonSets {
+			if !hasString((*resources).DaemonSets[ks.Namespace], ds.Name) {
+				(*resources).DaemonSets[ks.Namespace] = append((*resources).DaemonSets[ks.Namespace], ds.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func hasString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
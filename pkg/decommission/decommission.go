@@ -0,0 +1,379 @@
+package decommission
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/kubectl/pkg/drain"
+
+	"github.com/brnck/cni-migration/pkg"
+	"github.com/brnck/cni-migration/pkg/cloud"
+	"github.com/brnck/cni-migration/pkg/config"
+	"github.com/brnck/cni-migration/pkg/util"
+)
+
+var _ pkg.Step = &Decommission{}
+
+type Decommission struct {
+	ctx    context.Context
+	config *config.Config
+	client *kubernetes.Clientset
+
+	log     *logrus.Entry
+	factory *util.Factory
+}
+
+func New(ctx context.Context, config *config.Config) pkg.Step {
+	log := config.Log.WithField("step", "decommission")
+	return &Decommission{
+		ctx:     ctx,
+		log:     log,
+		config:  config,
+		client:  config.Client,
+		factory: util.New(ctx, log, config),
+	}
+}
+
+// Ready ensures that
+// - every AWS VPC CNI node left is cordoned and has no workloads
+func (d *Decommission) Ready() (bool, error) {
+	nodes, err := d.awsVpcCniNodes()
+	if err != nil {
+		return false, err
+	}
+
+	for _, node := range nodes {
+		if !node.Spec.Unschedulable {
+			return false, nil
+		}
+	}
+
+	workloads, err := d.factory.AwsVpcCniWorkloads(false)
+	if err != nil {
+		return false, err
+	}
+	for _, pods := range workloads {
+		if len(pods) > 0 {
+			return false, nil
+		}
+	}
+
+	d.log.Info("decommission step ready")
+
+	return true, nil
+}
+
+// Run will ensure that
+// - Cilium nodes are available to take the workloads
+// - AWS VPC CNI nodes are cordoned and drained, respecting PodDisruptionBudgets
+// - AWS VPC CNI nodes have no workloads left
+// - node groups of AWS VPC CNI nodes are scaled down, if configured
+func (d *Decommission) Run(dryrun bool) error {
+	nodes, err := d.awsVpcCniNodes()
+	if err != nil {
+		return err
+	}
+
+	if len(nodes) == 0 {
+		d.log.Info("no aws-vpc-cni nodes left")
+		return nil
+	}
+
+	if err := d.checkCiliumNodes(); err != nil {
+		return err
+	}
+
+	if err := d.drainNodes(nodes, dryrun); err != nil {
+		return err
+	}
+
+	if dryrun {
+		return d.scaleDown(nodes, true)
+	}
+
+	if err := d.waitEmpty(); err != nil {
+		return err
+	}
+
+	return d.scaleDown(nodes, false)
+}
+
+// checkCiliumNodes ensures there are ready Cilium nodes for drained pods to
+// be scheduled to.
+func (d *Decommission) checkCiliumNodes() error {
+	nodes, err := d.client.CoreV1().Nodes().List(d.ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", d.config.Labels.Cilium, d.config.Labels.Value),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes.Items {
+		if !node.Spec.Unschedulable && nodeReady(&node) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no ready, schedulable %s nodes to move the workloads of aws-vpc-cni nodes to", d.config.Labels.Cilium)
+}
+
+// drainNodes cordons and drains nodes, running up to the configured number
+// of drains at the same time.
+func (d *Decommission) drainNodes(nodes []corev1.Node, dryrun bool) error {
+	dc := d.config.Decommission
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+	)
+
+	sem := make(chan struct{}, dc.Concurrency)
+
+	for i := range nodes {
+		node := &nodes[i]
+
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if err := d.drainNode(node, dryrun); err != nil {
+				d.log.WithField("node", node.Name).Errorf("failed to drain: %s", err)
+
+				mu.Lock()
+				failed = append(failed, node.Name)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("failed to drain %d nodes: %s", len(failed), strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+func (d *Decommission) drainNode(node *corev1.Node, dryrun bool) error {
+	log := d.log.WithField("node", node.Name)
+	dc := d.config.Decommission
+
+	out, errOut := log.WriterLevel(logrus.DebugLevel), log.WriterLevel(logrus.WarnLevel)
+	defer out.Close()
+	defer errOut.Close()
+
+	helper := &drain.Helper{
+		Ctx:                 d.ctx,
+		Client:              d.client,
+		GracePeriodSeconds:  -1,
+		IgnoreAllDaemonSets: true,
+		DeleteEmptyDirData:  dc.DeleteEmptyDirData,
+		Timeout:             dc.DrainTimeout,
+		Out:                 out,
+		ErrOut:              errOut,
+		OnPodDeletedOrEvicted: func(pod *corev1.Pod, _ bool) {
+			log.Infof("evicted pod %s/%s", pod.Namespace, pod.Name)
+		},
+	}
+
+	if dryrun {
+		pods, errs := helper.GetPodsForDeletion(node.Name)
+		for _, err := range errs {
+			log.Warnf("would fail to drain: %s", err)
+		}
+		if pods != nil {
+			if w := pods.Warnings(); w != "" {
+				log.Warn(w)
+			}
+			log.Infof("would cordon and evict %d pods", len(pods.Pods()))
+		}
+		return nil
+	}
+
+	if !node.Spec.Unschedulable {
+		log.Info("cordoning node")
+		if err := drain.RunCordonOrUncordon(helper, node, true); err != nil {
+			return err
+		}
+	}
+
+	log.Info("draining node")
+	if err := drain.RunNodeDrain(helper, node.Name); err != nil {
+		return err
+	}
+
+	log.Info("node drained")
+
+	return nil
+}
+
+// waitEmpty waits until no workloads are left on AWS VPC CNI nodes.
+func (d *Decommission) waitEmpty() error {
+	timeout := d.config.Decommission.DrainTimeout
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+
+	for {
+		workloads, err := d.factory.AwsVpcCniWorkloads(false)
+		if err != nil {
+			return err
+		}
+
+		var left []string
+		for node, pods := range workloads {
+			for i := range pods {
+				left = append(left, node+": "+pods[i].Namespace+"/"+pods[i].Name)
+			}
+		}
+
+		if len(left) == 0 {
+			d.log.Info("aws-vpc-cni nodes are empty")
+			return nil
+		}
+
+		sort.Strings(left)
+		d.log.Debugf("waiting for %d pods to leave aws-vpc-cni nodes", len(left))
+
+		select {
+		case <-d.ctx.Done():
+			return fmt.Errorf("waiting for aws-vpc-cni nodes to be empty: %s", d.ctx.Err())
+		case <-deadline:
+			return fmt.Errorf("aws-vpc-cni nodes not empty after %s: %s", timeout, strings.Join(left, ", "))
+		case <-ticker.C:
+			continue
+		}
+	}
+}
+
+// scaleDown scales the node groups of nodes to zero, if a node group provider
+// is configured, and waits for the nodes to be removed. Node groups which
+// also have nodes without the AWS VPC CNI label are left unchanged.
+func (d *Decommission) scaleDown(nodes []corev1.Node, dryrun bool) error {
+	provider := d.config.Decommission.NodeGroupProvider
+	if provider == "" {
+		d.log.Info("no node group provider configured, aws-vpc-cni nodes are left cordoned to be removed manually")
+		return nil
+	}
+
+	nodeGroups, err := cloud.New(provider, d.config)
+	if err != nil {
+		return err
+	}
+
+	all, err := d.client.CoreV1().Nodes().List(d.ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	shared := make(map[string]bool)
+	for i := range all.Items {
+		node := &all.Items[i]
+		if node.Labels[d.config.Labels.AwsVpcCni] != d.config.Labels.Value {
+			shared[nodeGroups.NodeGroup(node)] = true
+		}
+	}
+
+	groups := make(map[string]bool)
+	for i := range nodes {
+		group := nodeGroups.NodeGroup(&nodes[i])
+		switch {
+		case group == "":
+			d.log.Warnf("node %s is not part of a %s node group, it must be removed manually", nodes[i].Name, provider)
+		case shared[group]:
+			d.log.Warnf("node group %s also has nodes not labelled for aws-vpc-cni, not scaling it down", group)
+		default:
+			groups[group] = true
+		}
+	}
+
+	var names []string
+	for group := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+
+	for _, group := range names {
+		d.log.Infof("scaling down node group %s", group)
+		if dryrun {
+			continue
+		}
+
+		if err := nodeGroups.ScaleDown(d.ctx, group); err != nil {
+			return fmt.Errorf("failed to scale down node group %s: %s", group, err)
+		}
+	}
+
+	if dryrun || len(names) == 0 {
+		return nil
+	}
+
+	return d.waitRemoved()
+}
+
+// waitRemoved waits until no AWS VPC CNI nodes are left.
+func (d *Decommission) waitRemoved() error {
+	timeout := d.config.Decommission.ScaleDownTimeout
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(time.Second * 10)
+	defer ticker.Stop()
+
+	for {
+		nodes, err := d.awsVpcCniNodes()
+		if err != nil {
+			return err
+		}
+
+		if len(nodes) == 0 {
+			d.log.Info("aws-vpc-cni nodes removed")
+			return nil
+		}
+
+		d.log.Debugf("waiting for %d aws-vpc-cni nodes to be removed", len(nodes))
+
+		select {
+		case <-d.ctx.Done():
+			return fmt.Errorf("waiting for aws-vpc-cni nodes removal: %s", d.ctx.Err())
+		case <-deadline:
+			return fmt.Errorf("%d aws-vpc-cni nodes not removed after %s", len(nodes), timeout)
+		case <-ticker.C:
+			continue
+		}
+	}
+}
+
+func (d *Decommission) awsVpcCniNodes() ([]corev1.Node, error) {
+	nodes, err := d.client.CoreV1().Nodes().List(d.ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", d.config.Labels.AwsVpcCni, d.config.Labels.Value),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes.Items, nil
+}
+
+func nodeReady(node *corev1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
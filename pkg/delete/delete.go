@@ -2,6 +2,10 @@ package delete
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
+
 	"github.com/brnck/cni-migration/pkg"
 	"github.com/brnck/cni-migration/pkg/config"
 	"github.com/brnck/cni-migration/pkg/util"
@@ -29,7 +33,7 @@ func New(ctx context.Context, config *config.Config) pkg.Step {
 		log:     log,
 		config:  config,
 		client:  config.Client,
-		factory: util.New(ctx, log, config.Client),
+		factory: util.New(ctx, log, config),
 	}
 }
 
@@ -43,6 +47,9 @@ func (d *Delete) Ready() (bool, error) {
 }
 
 // Run will ensure that
+// - no workloads are left on AWS VPC CNI nodes, unless forced
+// - AWS VPC CNI is not managed by the EKS add-on
+// - AWS VPC CNI daemon set and its configuration are backed up
 // - AWS VPC CNI daemon set is removed
 func (d *Delete) Run(dryrun bool) error {
 	exists, err := d.awsVpcCniExists()
@@ -53,6 +60,24 @@ func (d *Delete) Run(dryrun bool) error {
 		return nil
 	}
 
+	if err := d.checkDependents(); err != nil {
+		return err
+	}
+
+	// The add-on would re-create aws-node once deleted.
+	if err := d.factory.UnmanageAwsNodeAddon(dryrun); err != nil {
+		return err
+	}
+
+	if err := d.factory.BackupAwsNode(dryrun); err != nil {
+		return err
+	}
+
+	if dryrun {
+		d.log.Info("would remove aws-node daemon set")
+		return nil
+	}
+
 	if err = d.client.AppsV1().
 		DaemonSets(d.config.AwsVpcCni.Namespace).
 		Delete(d.ctx, d.config.AwsVpcCni.DaemonsetName, metav1.DeleteOptions{}); err != nil {
@@ -64,6 +89,62 @@ func (d *Delete) Run(dryrun bool) error {
 	return nil
 }
 
+// checkDependents refuses to delete aws-node while pods on AWS VPC CNI nodes
+// still depend on it, unless awsVpcCni.forceDelete is set. Daemon set pods
+// are included, as the nodes left are not scaled away and keep running them.
+func (d *Delete) checkDependents() error {
+	workloads, err := d.factory.AwsVpcCniWorkloads(true)
+	if err != nil {
+		return err
+	}
+
+	var nodes []string
+	pods := 0
+	for node, nodePods := range workloads {
+		if len(nodePods) > 0 {
+			nodes = append(nodes, node)
+			pods += len(nodePods)
+		}
+	}
+
+	if len(nodes) == 0 {
+		d.log.Infof("no workloads left on %d aws-vpc-cni nodes", len(workloads))
+		return nil
+	}
+
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		var owners []string
+		for i := range workloads[node] {
+			pod := &workloads[node][i]
+			owner := pod.Namespace + "/" + util.PodOwner(pod)
+			if !hasString(owners, owner) {
+				owners = append(owners, owner)
+			}
+		}
+		sort.Strings(owners)
+
+		d.log.WithField("node", node).Warnf("%d pods still use aws-vpc-cni: %s",
+			len(workloads[node]), strings.Join(owners, ", "))
+	}
+
+	if d.config.AwsVpcCni.ForceDelete {
+		d.log.Warnf("%d pods on %d aws-vpc-cni nodes still use aws-node, deleting it as forced", pods, len(nodes))
+		return nil
+	}
+
+	return fmt.Errorf("%d pods on %d aws-vpc-cni nodes still use aws-node, drain or remove the nodes or set awsVpcCni.forceDelete", pods, len(nodes))
+}
+
+func hasString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *Delete) awsVpcCniExists() (bool, error) {
 	ds, err := d.client.AppsV1().
 		DaemonSets(d.config.AwsVpcCni.Namespace).
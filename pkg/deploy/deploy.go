@@ -6,11 +6,10 @@ import (
 	"github.com/brnck/cni-migration/pkg"
 	"github.com/brnck/cni-migration/pkg/config"
 	"github.com/brnck/cni-migration/pkg/util"
+	"github.com/brnck/cni-migration/pkg/values"
 	helmclient "github.com/mittwald/go-helm-client"
 	"github.com/sirupsen/logrus"
-	"helm.sh/helm/v3/pkg/repo"
 	"k8s.io/client-go/kubernetes"
-	"os"
 	"time"
 )
 
@@ -34,7 +33,7 @@ func New(ctx context.Context, config *config.Config) pkg.Step {
 		config:     config,
 		client:     config.Client,
 		helmClient: config.HelmClient,
-		factory:    util.New(ctx, log, config.Client),
+		factory:    util.New(ctx, log, config),
 	}
 }
 
@@ -43,7 +42,7 @@ func New(ctx context.Context, config *config.Config) pkg.Step {
 func (d *Deploy) Ready() (bool, error) {
 	d.log.Info("checking if cilium helm release exists")
 
-	release, err := d.helmClient.GetRelease("cilium")
+	release, err := d.helmClient.GetRelease(d.config.Cilium.ReleaseName)
 	if err != nil || release == nil {
 		return false, err
 	}
@@ -55,6 +54,8 @@ func (d *Deploy) Ready() (bool, error) {
 
 // Run will ensure that
 // - Cilium is deployed to the cluster
+// - Cilium agents and nodes are healthy
+// - Pods on Cilium nodes are managed by Cilium
 func (d *Deploy) Run(dryrun bool) error {
 	if exists, _ := d.helmClient.GetRelease(d.config.Cilium.ReleaseName); exists != nil {
 		d.log.Info("cilium already deployed. Skipping...")
@@ -63,47 +64,36 @@ func (d *Deploy) Run(dryrun bool) error {
 
 	d.log.Info("deploying cilium helm release")
 
-	if err := d.helmClient.AddOrUpdateChartRepo(repo.Entry{
-		Name: "cilium",
-		URL:  d.config.Cilium.RepoPath,
-	}); err != nil {
+	chart, err := d.factory.CiliumChart()
+	if err != nil {
+		return err
+	}
+
+	vals, err := values.Build(d.config, values.PreMigration)
+	if err != nil {
 		return err
 	}
 
-	values, err := os.ReadFile(d.config.CiliumPreMigration)
+	valuesYaml, err := vals.YAML()
 	if err != nil {
 		return err
 	}
 
+	d.log.Infof("effective cilium values:\n%s", valuesYaml)
+
 	spec := &helmclient.ChartSpec{
 		ReleaseName: d.config.Cilium.ReleaseName,
-		ChartName:   d.config.Cilium.ChartName,
+		ChartName:   chart,
 		Namespace:   d.config.Cilium.Namespace,
-		ValuesYaml:  string(values),
+		ValuesYaml:  valuesYaml,
 		Version:     d.config.Cilium.Version,
 		Timeout:     30 * time.Minute,
 		DryRun:      dryrun,
 	}
-	if _, err = d.helmClient.InstallOrUpgradeChart(d.ctx, spec, nil); err != nil {
+	if err = d.factory.ReleaseCilium(spec, false); err != nil {
 		return err
 	}
 
-	backOff := 5
-
-	for backOff != 0 {
-		release, err := d.helmClient.GetRelease(spec.ReleaseName)
-		if err != nil {
-			return err
-		}
-
-		if !release.Info.Status.IsPending() {
-			break
-		}
-
-		backOff -= 1
-		time.Sleep(1 * time.Second)
-	}
-
 	if err = d.factory.WaitDeploymentReady(
 		d.config.Cilium.Namespace,
 		fmt.Sprintf("%s-operator", d.config.Cilium.ReleaseName)); err != nil {
@@ -111,7 +101,17 @@ func (d *Deploy) Run(dryrun bool) error {
 	}
 
 	if err = d.factory.CheckKnetStress(); err != nil {
-		return nil
+		return err
+	}
+
+	if !dryrun {
+		if err = d.factory.CheckCiliumHealth(); err != nil {
+			return err
+		}
+
+		if err = d.factory.CheckCiliumManagedPods(); err != nil {
+			return err
+		}
 	}
 
 	d.log.Infof("%s deployed to %s namespace", d.config.Cilium.ReleaseName, d.config.Cilium.Namespace)
@@ -0,0 +1,30 @@
+package hubble
+
+import (
+	"fmt"
+)
+
+// rawCodec is a gRPC codec passing already encoded protobuf messages through
+// as *[]byte, so the observer API can be used without generated code.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return *b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
@@ -0,0 +1,86 @@
+package hubble
+
+import (
+	"net"
+
+	"google.golang.org/grpc"
+)
+
+// FakeServer is a local Hubble Relay serving a fixed set of flows on the
+// observer API. It is intended to be used in tests in place of a real Relay.
+type FakeServer struct {
+	flows    []*Flow
+	listener net.Listener
+	server   *grpc.Server
+
+	// closeStream ends streams once all flows are sent, instead of holding
+	// them open.
+	closeStream bool
+}
+
+// NewFakeServer starts a fake Relay on a random local port. Every GetFlows
+// call receives all flows, after which the stream is held open until the
+// client cancels it, mimicking a following request.
+func NewFakeServer(flows ...*Flow) (*FakeServer, error) {
+	return newFakeServer(false, flows...)
+}
+
+func newFakeServer(closeStream bool, flows ...*Flow) (*FakeServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FakeServer{
+		flows:       flows,
+		listener:    listener,
+		server:      grpc.NewServer(grpc.ForceServerCodec(rawCodec{})),
+		closeStream: closeStream,
+	}
+
+	s.server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "observer.Observer",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{
+			{
+				StreamName:    getFlowsStreamDesc.StreamName,
+				ServerStreams: true,
+				Handler:       s.getFlows,
+			},
+		},
+	}, s)
+
+	go s.server.Serve(listener)
+
+	return s, nil
+}
+
+// Address returns the address the fake Relay is listening on.
+func (s *FakeServer) Address() string {
+	return s.listener.Addr().String()
+}
+
+// Stop stops the fake Relay.
+func (s *FakeServer) Stop() {
+	s.server.Stop()
+}
+
+func (s *FakeServer) getFlows(_ interface{}, stream grpc.ServerStream) error {
+	var req []byte
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+
+	for _, flow := range s.flows {
+		resp := encodeGetFlowsResponse(flow)
+		if err := stream.SendMsg(&resp); err != nil {
+			return err
+		}
+	}
+
+	if !s.closeStream {
+		<-stream.Context().Done()
+	}
+
+	return nil
+}
@@ -0,0 +1,276 @@
+package hubble
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the Hubble observer and flow protobuf messages, see
+// https://github.com/cilium/cilium/tree/main/api/v1/observer and
+// https://github.com/cilium/cilium/tree/main/api/v1/flow. Only the fields
+// needed to analyse dropped flows are encoded and decoded.
+const (
+	getFlowsRequestFollow    protowire.Number = 3
+	getFlowsRequestWhitelist protowire.Number = 6
+
+	getFlowsResponseFlow     protowire.Number = 1
+	getFlowsResponseNodeName protowire.Number = 1000
+
+	flowFilterVerdict protowire.Number = 5
+
+	flowVerdict        protowire.Number = 2
+	flowDropReason     protowire.Number = 3
+	flowIP             protowire.Number = 5
+	flowSource         protowire.Number = 8
+	flowDestination    protowire.Number = 9
+	flowNodeName       protowire.Number = 11
+	flowDropReasonDesc protowire.Number = 25
+
+	ipSource      protowire.Number = 1
+	ipDestination protowire.Number = 2
+
+	endpointNamespace protowire.Number = 3
+	endpointPodName   protowire.Number = 5
+)
+
+// VerdictDropped is the flow.Verdict value of dropped and denied flows.
+const VerdictDropped = 2
+
+// dropReasons are the names of the flow.DropReason values most commonly seen
+// during a migration. Unknown values are reported by number.
+var dropReasons = map[uint64]string{
+	0:   "DROP_REASON_UNKNOWN",
+	130: "INVALID_SOURCE_MAC",
+	131: "INVALID_DESTINATION_MAC",
+	132: "INVALID_SOURCE_IP",
+	133: "POLICY_DENIED",
+	134: "INVALID_PACKET_DROPPED",
+	135: "CT_TRUNCATED_OR_INVALID_HEADER",
+	136: "CT_MISSING_TCP_ACK_FLAG",
+	137: "CT_UNKNOWN_L4_PROTOCOL",
+	138: "CT_CANNOT_CREATE_ENTRY_FROM_PACKET",
+	139: "UNSUPPORTED_L3_PROTOCOL",
+	140: "MISSED_TAIL_CALL",
+	141: "ERROR_WRITING_TO_PACKET",
+	142: "UNKNOWN_L4_PROTOCOL",
+	181: "POLICY_DENY",
+}
+
+// Endpoint is one side of a flow.
+type Endpoint struct {
+	Namespace string
+	PodName   string
+	IP        string
+}
+
+func (e Endpoint) String() string {
+	if e.PodName != "" {
+		return e.Namespace + "/" + e.PodName
+	}
+	if e.IP != "" {
+		return e.IP
+	}
+	return "unknown"
+}
+
+// Flow is a decoded Hubble flow.
+type Flow struct {
+	NodeName    string
+	Verdict     uint64
+	DropReason  uint64
+	Source      Endpoint
+	Destination Endpoint
+}
+
+// DropReasonName returns the name of the flow drop reason.
+func (f *Flow) DropReasonName() string {
+	if name, ok := dropReasons[f.DropReason]; ok {
+		return name
+	}
+	return fmt.Sprintf("DROP_REASON_%d", f.DropReason)
+}
+
+// encodeGetFlowsRequest encodes a following GetFlowsRequest which only
+// returns flows with the given verdict.
+func encodeGetFlowsRequest(verdict uint64) []byte {
+	var filter []byte
+	filter = protowire.AppendTag(filter, flowFilterVerdict, protowire.VarintType)
+	filter = protowire.AppendVarint(filter, verdict)
+
+	var b []byte
+	b = protowire.AppendTag(b, getFlowsRequestFollow, protowire.VarintType)
+	b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	b = protowire.AppendTag(b, getFlowsRequestWhitelist, protowire.BytesType)
+	b = protowire.AppendBytes(b, filter)
+	return b
+}
+
+// decodeGetFlowsResponse decodes a GetFlowsResponse. A nil flow is returned
+// for responses which do not contain a flow, such as node status events.
+func decodeGetFlowsResponse(b []byte) (*Flow, error) {
+	var (
+		flow     *Flow
+		nodeName string
+	)
+
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch {
+		case num == getFlowsResponseFlow && typ == protowire.BytesType:
+			f, err := decodeFlow(v)
+			if err != nil {
+				return err
+			}
+			flow = f
+		case num == getFlowsResponseNodeName && typ == protowire.BytesType:
+			nodeName = string(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if flow != nil && flow.NodeName == "" {
+		flow.NodeName = nodeName
+	}
+
+	return flow, nil
+}
+
+func decodeFlow(b []byte) (*Flow, error) {
+	flow := new(Flow)
+	var dropReason, dropReasonDesc uint64
+
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		var err error
+		switch {
+		case num == flowVerdict && typ == protowire.VarintType:
+			flow.Verdict = n
+		case num == flowDropReason && typ == protowire.VarintType:
+			dropReason = n
+		case num == flowDropReasonDesc && typ == protowire.VarintType:
+			dropReasonDesc = n
+		case num == flowNodeName && typ == protowire.BytesType:
+			flow.NodeName = string(v)
+		case num == flowIP && typ == protowire.BytesType:
+			err = consumeFields(v, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+				switch {
+				case num == ipSource && typ == protowire.BytesType:
+					flow.Source.IP = string(v)
+				case num == ipDestination && typ == protowire.BytesType:
+					flow.Destination.IP = string(v)
+				}
+				return nil
+			})
+		case num == flowSource && typ == protowire.BytesType:
+			err = decodeEndpoint(v, &flow.Source)
+		case num == flowDestination && typ == protowire.BytesType:
+			err = decodeEndpoint(v, &flow.Destination)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	flow.DropReason = dropReasonDesc
+	if flow.DropReason == 0 {
+		flow.DropReason = dropReason
+	}
+
+	return flow, nil
+}
+
+func decodeEndpoint(b []byte, endpoint *Endpoint) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		switch {
+		case num == endpointNamespace && typ == protowire.BytesType:
+			endpoint.Namespace = string(v)
+		case num == endpointPodName && typ == protowire.BytesType:
+			endpoint.PodName = string(v)
+		}
+		return nil
+	})
+}
+
+// encodeGetFlowsResponse encodes a flow as a GetFlowsResponse. It is used by
+// the fake server.
+func encodeGetFlowsResponse(flow *Flow) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, getFlowsResponseFlow, protowire.BytesType)
+	b = protowire.AppendBytes(b, encodeFlow(flow))
+	b = appendString(b, getFlowsResponseNodeName, flow.NodeName)
+	return b
+}
+
+func encodeFlow(flow *Flow) []byte {
+	var ip []byte
+	ip = appendString(ip, ipSource, flow.Source.IP)
+	ip = appendString(ip, ipDestination, flow.Destination.IP)
+
+	var b []byte
+	b = protowire.AppendTag(b, flowVerdict, protowire.VarintType)
+	b = protowire.AppendVarint(b, flow.Verdict)
+	b = protowire.AppendTag(b, flowIP, protowire.BytesType)
+	b = protowire.AppendBytes(b, ip)
+	b = protowire.AppendTag(b, flowSource, protowire.BytesType)
+	b = protowire.AppendBytes(b, encodeEndpoint(flow.Source))
+	b = protowire.AppendTag(b, flowDestination, protowire.BytesType)
+	b = protowire.AppendBytes(b, encodeEndpoint(flow.Destination))
+	b = appendString(b, flowNodeName, flow.NodeName)
+	b = protowire.AppendTag(b, flowDropReasonDesc, protowire.VarintType)
+	b = protowire.AppendVarint(b, flow.DropReason)
+	return b
+}
+
+func encodeEndpoint(endpoint Endpoint) []byte {
+	var b []byte
+	b = appendString(b, endpointNamespace, endpoint.Namespace)
+	b = appendString(b, endpointPodName, endpoint.PodName)
+	return b
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// consumeFields calls fn for every field in b. Bytes fields are passed as v,
+// varint fields as n. Other field types are skipped.
+func consumeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+
+		var (
+			v []byte
+			n uint64
+		)
+
+		switch typ {
+		case protowire.BytesType:
+			v, l = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			n, l = protowire.ConsumeVarint(b)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+
+		if err := fn(num, typ, v, n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package hubble
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/brnck/cni-migration/pkg/config"
+)
+
+const (
+	getFlowsMethod = "/observer.Observer/GetFlows"
+
+	defaultRelayAddress = "localhost:4245"
+	defaultRelayService = "hubble-relay"
+	defaultRelayPort    = 80
+
+	dialTimeout = 10 * time.Second
+)
+
+var getFlowsStreamDesc = &grpc.StreamDesc{
+	StreamName:    "GetFlows",
+	ServerStreams: true,
+}
+
+// Observer streams dropped flows from Hubble Relay and aggregates them into a
+// Report.
+type Observer struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	config *config.Hubble
+	log    *logrus.Entry
+
+	namespace   string
+	conn        *grpc.ClientConn
+	portForward *exec.Cmd
+	report      *Report
+	done        chan struct{}
+}
+
+func NewObserver(ctx context.Context, log *logrus.Entry, config *config.Config) *Observer {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Observer{
+		ctx:       ctx,
+		cancel:    cancel,
+		config:    config.Hubble,
+		log:       log,
+		namespace: config.Cilium.Namespace,
+		report:    NewReport(),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start connects to Hubble Relay, port forwarding to the relay service if
+// configured, and starts collecting dropped flows in the background.
+func (o *Observer) Start() error {
+	address := o.config.RelayAddress
+	if address == "" {
+		address = defaultRelayAddress
+	}
+
+	if o.config.PortForward {
+		if err := o.startPortForward(address); err != nil {
+			return err
+		}
+	}
+
+	dialCtx, cancel := context.WithTimeout(o.ctx, dialTimeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(dialCtx, address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		o.stopPortForward()
+		return fmt.Errorf("failed to connect to hubble relay at %s: %s", address, err)
+	}
+	o.conn = conn
+
+	stream, err := conn.NewStream(o.ctx, getFlowsStreamDesc, getFlowsMethod, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		o.close()
+		return fmt.Errorf("failed to observe hubble flows: %s", err)
+	}
+
+	req := encodeGetFlowsRequest(VerdictDropped)
+	if err := stream.SendMsg(&req); err != nil {
+		o.close()
+		return fmt.Errorf("failed to observe hubble flows: %s", err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		o.close()
+		return fmt.Errorf("failed to observe hubble flows: %s", err)
+	}
+
+	o.log.Infof("observing dropped flows from hubble relay at %s", address)
+
+	go func() {
+		defer close(o.done)
+
+		for {
+			var resp []byte
+			if err := stream.RecvMsg(&resp); err != nil {
+				if o.ctx.Err() == nil {
+					o.log.Warnf("hubble flow stream closed: %s", err)
+				}
+				return
+			}
+
+			flow, err := decodeGetFlowsResponse(resp)
+			if err != nil {
+				o.log.Warnf("failed to decode hubble flow: %s", err)
+				continue
+			}
+
+			if flow != nil && flow.Verdict == VerdictDropped {
+				o.report.Add(flow)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops observing flows and returns the aggregated report.
+func (o *Observer) Stop() *Report {
+	o.cancel()
+	<-o.done
+	o.close()
+	return o.report
+}
+
+func (o *Observer) close() {
+	if o.conn != nil {
+		o.conn.Close()
+	}
+	o.stopPortForward()
+}
+
+func (o *Observer) startPortForward(address string) error {
+	_, localPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("failed to parse hubble relay address %q: %s", address, err)
+	}
+
+	service := o.config.RelayService
+	if service == "" {
+		service = defaultRelayService
+	}
+
+	port := o.config.RelayPort
+	if port == 0 {
+		port = defaultRelayPort
+	}
+
+	args := []string{"kubectl", "port-forward", "--namespace", o.namespace,
+		"svc/" + service, fmt.Sprintf("%s:%d", localPort, port)}
+	o.log.Debugf("%s", args)
+
+	cmd := exec.CommandContext(o.ctx, args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to port forward to hubble relay: %s", err)
+	}
+	o.portForward = cmd
+
+	return nil
+}
+
+func (o *Observer) stopPortForward() {
+	if o.portForward == nil {
+		return
+	}
+
+	_ = o.portForward.Process.Kill()
+	_ = o.portForward.Wait()
+	o.portForward = nil
+}
@@ -0,0 +1,171 @@
+package hubble
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/brnck/cni-migration/pkg/config"
+)
+
+func TestObserverReport(t *testing.T) {
+	flows := []*Flow{
+		{
+			NodeName:    "node-a",
+			Verdict:     VerdictDropped,
+			DropReason:  133,
+			Source:      Endpoint{Namespace: "default", PodName: "client", IP: "10.0.0.1"},
+			Destination: Endpoint{Namespace: "default", PodName: "server", IP: "10.0.0.2"},
+		},
+		{
+			NodeName:    "node-a",
+			Verdict:     VerdictDropped,
+			DropReason:  133,
+			Source:      Endpoint{Namespace: "default", PodName: "client", IP: "10.0.0.1"},
+			Destination: Endpoint{IP: "10.0.1.5"},
+		},
+		{
+			NodeName:    "node-b",
+			Verdict:     VerdictDropped,
+			DropReason:  181,
+			Source:      Endpoint{IP: "192.168.0.1"},
+			Destination: Endpoint{Namespace: "kube-system", PodName: "coredns", IP: "10.0.0.3"},
+		},
+		{
+			// Forwarded flows are not reported.
+			NodeName:    "node-b",
+			Verdict:     1,
+			Source:      Endpoint{Namespace: "default", PodName: "client", IP: "10.0.0.1"},
+			Destination: Endpoint{Namespace: "default", PodName: "server", IP: "10.0.0.2"},
+		},
+	}
+
+	srv, err := newFakeServer(true, flows...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	c := &config.Config{
+		Hubble: &config.Hubble{RelayAddress: srv.Address()},
+		Cilium: &config.Cilium{Namespace: "kube-system"},
+	}
+
+	observer := NewObserver(context.TODO(), logrus.NewEntry(logrus.New()), c)
+	if err := observer.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-observer.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for flows")
+	}
+
+	report := observer.Stop()
+
+	if report.Total != 3 {
+		t.Errorf("expected 3 dropped flows, got %d", report.Total)
+	}
+
+	for _, exp := range []struct {
+		name   string
+		counts map[string]int
+		exp    map[string]int
+	}{
+		{"reason", report.ByReason, map[string]int{"POLICY_DENIED": 2, "POLICY_DENY": 1}},
+		{"source", report.BySource, map[string]int{"default/client": 2, "192.168.0.1": 1}},
+		{"destination", report.ByDestination, map[string]int{"default/server": 1, "10.0.1.5": 1, "kube-system/coredns": 1}},
+	} {
+		if len(exp.counts) != len(exp.exp) {
+			t.Errorf("expected by %s %v, got %v", exp.name, exp.exp, exp.counts)
+			continue
+		}
+		for key, count := range exp.exp {
+			if exp.counts[key] != count {
+				t.Errorf("expected by %s %v, got %v", exp.name, exp.exp, exp.counts)
+				break
+			}
+		}
+	}
+
+	if err := report.Check(2); err == nil {
+		t.Error("expected 3 dropped flows to exceed a threshold of 2")
+	}
+	if err := report.Check(3); err != nil {
+		t.Errorf("unexpected error for a threshold of 3: %s", err)
+	}
+}
+
+func TestDecodeGetFlowsResponse(t *testing.T) {
+	exp := &Flow{
+		NodeName:    "node-a",
+		Verdict:     VerdictDropped,
+		DropReason:  181,
+		Source:      Endpoint{Namespace: "default", PodName: "client", IP: "10.0.0.1"},
+		Destination: Endpoint{Namespace: "default", PodName: "server", IP: "10.0.0.2"},
+	}
+
+	flow, err := decodeGetFlowsResponse(encodeGetFlowsResponse(exp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *flow != *exp {
+		t.Errorf("expected %+v, got %+v", exp, flow)
+	}
+
+	// The node name of the response is used if the flow has none.
+	var resp []byte
+	resp = protowire.AppendTag(resp, getFlowsResponseFlow, protowire.BytesType)
+	resp = protowire.AppendBytes(resp, encodeFlow(&Flow{Verdict: VerdictDropped, DropReason: 133}))
+	resp = appendString(resp, getFlowsResponseNodeName, "node-b")
+
+	flow, err = decodeGetFlowsResponse(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flow.NodeName != "node-b" || flow.DropReasonName() != "POLICY_DENIED" {
+		t.Errorf("expected node-b and POLICY_DENIED, got %s and %s", flow.NodeName, flow.DropReasonName())
+	}
+
+	// Responses without a flow, such as node status events, are skipped.
+	flow, err = decodeGetFlowsResponse(appendString(nil, getFlowsResponseNodeName, "node-b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flow != nil {
+		t.Errorf("expected no flow, got %+v", flow)
+	}
+}
+
+func TestEncodeGetFlowsRequest(t *testing.T) {
+	var (
+		follow  bool
+		verdict uint64
+	)
+
+	err := consumeFields(encodeGetFlowsRequest(VerdictDropped), func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch {
+		case num == getFlowsRequestFollow && typ == protowire.VarintType:
+			follow = protowire.DecodeBool(n)
+		case num == getFlowsRequestWhitelist && typ == protowire.BytesType:
+			return consumeFields(v, func(num protowire.Number, typ protowire.Type, _ []byte, n uint64) error {
+				if num == flowFilterVerdict && typ == protowire.VarintType {
+					verdict = n
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !follow || verdict != VerdictDropped {
+		t.Errorf("expected a following request filtering verdict %d, got follow=%t verdict=%d", VerdictDropped, follow, verdict)
+	}
+}
@@ -0,0 +1,90 @@
+package hubble
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reportTopN is the number of entries logged for each aggregation.
+const reportTopN = 10
+
+// Report aggregates dropped flows by drop reason, source and destination.
+type Report struct {
+	Total         int
+	ByReason      map[string]int
+	BySource      map[string]int
+	ByDestination map[string]int
+}
+
+func NewReport() *Report {
+	return &Report{
+		ByReason:      make(map[string]int),
+		BySource:      make(map[string]int),
+		ByDestination: make(map[string]int),
+	}
+}
+
+// Add records a dropped flow.
+func (r *Report) Add(flow *Flow) {
+	r.Total++
+	r.ByReason[flow.DropReasonName()]++
+	r.BySource[flow.Source.String()]++
+	r.ByDestination[flow.Destination.String()]++
+}
+
+// Log writes the report, with the most frequent entries of each aggregation.
+func (r *Report) Log(log *logrus.Entry) {
+	if r.Total == 0 {
+		log.Info("hubble observed no dropped flows")
+		return
+	}
+
+	log.Warnf("hubble observed %d dropped flows", r.Total)
+	for _, agg := range []struct {
+		name   string
+		counts map[string]int
+	}{
+		{"reason", r.ByReason},
+		{"source", r.BySource},
+		{"destination", r.ByDestination},
+	} {
+		for _, entry := range topN(agg.counts, reportTopN) {
+			log.Warnf("  dropped by %s %s: %d", agg.name, entry.key, entry.count)
+		}
+	}
+}
+
+// Check returns an error if the number of dropped flows exceeds threshold.
+func (r *Report) Check(threshold int) error {
+	if r.Total > threshold {
+		return fmt.Errorf("hubble observed %d dropped flows, exceeding threshold of %d", r.Total, threshold)
+	}
+	return nil
+}
+
+type countEntry struct {
+	key   string
+	count int
+}
+
+func topN(counts map[string]int, n int) []countEntry {
+	entries := make([]countEntry, 0, len(counts))
+	for key, count := range counts {
+		entries = append(entries, countEntry{key, count})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].count == entries[j].count {
+			return entries[i].key < entries[j].key
+		}
+		return entries[i].count > entries[j].count
+	})
+
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+
+	return entries
+}
@@ -0,0 +1,63 @@
+package hubble
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/brnck/cni-migration/pkg"
+	"github.com/brnck/cni-migration/pkg/config"
+)
+
+var _ pkg.Step = &observedStep{}
+
+// observedStep observes dropped flows while a live step runs.
+type observedStep struct {
+	pkg.Step
+
+	ctx    context.Context
+	config *config.Config
+	log    *logrus.Entry
+}
+
+// Observe wraps step so that dropped flows are observed through Hubble Relay
+// while it runs. If Relay can not be reached, for example because Cilium is
+// not deployed yet, the step runs without observation.
+func Observe(ctx context.Context, config *config.Config, step pkg.Step) pkg.Step {
+	return &observedStep{
+		Step:   step,
+		ctx:    ctx,
+		config: config,
+		log:    config.Log.WithField("observer", "hubble"),
+	}
+}
+
+func (o *observedStep) Run(dryrun bool) error {
+	if dryrun {
+		return o.Step.Run(dryrun)
+	}
+
+	observer := NewObserver(o.ctx, o.log, o.config)
+	if err := observer.Start(); err != nil {
+		o.log.Warnf("not observing dropped flows: %s", err)
+		return o.Step.Run(dryrun)
+	}
+
+	runErr := o.Step.Run(dryrun)
+
+	report := observer.Stop()
+	report.Log(o.log)
+
+	if runErr != nil {
+		return runErr
+	}
+
+	if err := report.Check(o.config.Hubble.DropThreshold); err != nil {
+		if o.config.Hubble.FailOnDrops {
+			return err
+		}
+		o.log.Warn(err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,384 @@
+package kubeproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	helmclient "github.com/mittwald/go-helm-client"
+	"github.com/sirupsen/logrus"
+	"helm.sh/helm/v3/pkg/chartutil"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+
+	"github.com/brnck/cni-migration/pkg"
+	"github.com/brnck/cni-migration/pkg/config"
+	"github.com/brnck/cni-migration/pkg/util"
+	"github.com/brnck/cni-migration/pkg/values"
+)
+
+var _ pkg.Step = &KubeProxy{}
+
+type KubeProxy struct {
+	ctx        context.Context
+	config     *config.Config
+	client     *kubernetes.Clientset
+	helmClient helmclient.Client
+
+	log     *logrus.Entry
+	factory *util.Factory
+}
+
+func New(ctx context.Context, config *config.Config) pkg.Step {
+	log := config.Log.WithField("step", "10-kube-proxy")
+	return &KubeProxy{
+		ctx:        ctx,
+		log:        log,
+		config:     config,
+		client:     config.Client,
+		helmClient: config.HelmClient,
+		factory:    util.New(ctx, log, config),
+	}
+}
+
+// Ready ensures that, if kube-proxy replacement is enabled
+// - Cilium is released with kube-proxy replacement
+// - kube-proxy daemon set is removed
+func (k *KubeProxy) Ready() (bool, error) {
+	if !k.config.KubeProxyReplacement.Enabled {
+		return true, nil
+	}
+
+	release, err := k.helmClient.GetRelease(k.config.Cilium.ReleaseName)
+	if err != nil || release == nil {
+		return false, err
+	}
+
+	if !replacementEnabled(release.Config["kubeProxyReplacement"]) {
+		return false, nil
+	}
+
+	ds, err := k.kubeProxy()
+	if err != nil || ds != nil {
+		return false, err
+	}
+
+	k.log.Info("step 10 ready")
+
+	return true, nil
+}
+
+// Run will ensure that, if kube-proxy replacement is enabled
+// - Cilium agents can reach the API server directly
+// - Cilium is upgraded with kube-proxy replacement
+// - kube-proxy daemon set is backed up and removed
+// - Services are reachable from every Cilium node
+// - everything is reverted if the checks fail
+func (k *KubeProxy) Run(dryrun bool) error {
+	kpr := k.config.KubeProxyReplacement
+	if !kpr.Enabled {
+		k.log.Info("kube-proxy replacement is not enabled, skipping")
+		return nil
+	}
+
+	host, port, err := k.apiServer()
+	if err != nil {
+		return err
+	}
+	apiServer := net.JoinHostPort(host, strconv.Itoa(port))
+
+	k.log.Infof("checking cilium agents can reach the api server at %s", apiServer)
+	if err := k.factory.CheckCiliumAgentConnectivity(apiServer); err != nil {
+		return err
+	}
+
+	backup, err := k.kubeProxy()
+	if err != nil {
+		return err
+	}
+
+	if backup != nil {
+		if err := k.backup(backup, dryrun); err != nil {
+			return err
+		}
+	} else {
+		// kube-proxy was removed by a previous run, which can still be
+		// reverted from its backup.
+		if backup, err = k.loadBackup(); err != nil {
+			return err
+		}
+	}
+
+	chart, err := k.factory.CiliumChart()
+	if err != nil {
+		return err
+	}
+
+	if err := k.release(chart, host, port, dryrun); err != nil {
+		return err
+	}
+
+	if dryrun {
+		k.log.Infof("would remove %s/%s", kpr.Namespace, kpr.DaemonSetName)
+		return nil
+	}
+
+	err = k.replaceKubeProxy()
+	if err == nil {
+		k.log.Info("kube-proxy replaced by cilium")
+		return nil
+	}
+
+	if kpr.KeepOnFailure {
+		return fmt.Errorf("kube-proxy replacement failed, not reverting as configured: %s", err)
+	}
+
+	k.log.Errorf("kube-proxy replacement failed, reverting: %s", err)
+
+	if revertErr := k.revert(chart, backup); revertErr != nil {
+		return fmt.Errorf("kube-proxy replacement failed: %s, revert failed: %s", err, revertErr)
+	}
+
+	return fmt.Errorf("kube-proxy replacement failed and was reverted: %s", err)
+}
+
+// replaceKubeProxy removes kube-proxy and its rules, and checks Services are
+// still reachable through Cilium.
+func (k *KubeProxy) replaceKubeProxy() error {
+	kpr := k.config.KubeProxyReplacement
+
+	err := k.client.AppsV1().DaemonSets(kpr.Namespace).Delete(k.ctx, kpr.DaemonSetName, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		k.log.Infof("%s/%s daemon set removed", kpr.Namespace, kpr.DaemonSetName)
+	}
+
+	if err := k.factory.FlushKubeProxyRules(); err != nil {
+		return err
+	}
+
+	if err := k.factory.CheckCiliumHealth(); err != nil {
+		return err
+	}
+
+	services, err := k.serviceAddresses()
+	if err != nil {
+		return err
+	}
+
+	if err := k.factory.CheckCiliumAgentConnectivity(services...); err != nil {
+		return err
+	}
+
+	return k.factory.CheckKnetStress()
+}
+
+// revert restores kube-proxy from the backup and releases Cilium without
+// kube-proxy replacement.
+func (k *KubeProxy) revert(chart string, backup *appsv1.DaemonSet) error {
+	if backup != nil {
+		kpr := k.config.KubeProxyReplacement
+
+		_, err := k.client.AppsV1().DaemonSets(kpr.Namespace).Create(k.ctx, backup, metav1.CreateOptions{})
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+
+		if err := k.factory.WaitDaemonSetReady(kpr.Namespace, kpr.DaemonSetName); err != nil {
+			return err
+		}
+		k.log.Infof("%s/%s daemon set restored", kpr.Namespace, kpr.DaemonSetName)
+	}
+
+	vals, err := values.Build(k.config, values.PostMigration)
+	if err != nil {
+		return err
+	}
+
+	return k.upgrade(chart, vals, false)
+}
+
+func (k *KubeProxy) release(chart, host string, port int, dryrun bool) error {
+	vals, err := values.KubeProxyReplacement(k.config, host, port)
+	if err != nil {
+		return err
+	}
+
+	return k.upgrade(chart, vals, dryrun)
+}
+
+func (k *KubeProxy) upgrade(chart string, vals chartutil.Values, dryrun bool) error {
+	valuesYaml, err := vals.YAML()
+	if err != nil {
+		return err
+	}
+
+	k.log.Infof("effective cilium values:\n%s", valuesYaml)
+
+	spec := &helmclient.ChartSpec{
+		ReleaseName: k.config.Cilium.ReleaseName,
+		ChartName:   chart,
+		Namespace:   k.config.Cilium.Namespace,
+		ValuesYaml:  valuesYaml,
+		Version:     k.config.Cilium.Version,
+		Timeout:     30 * time.Minute,
+		DryRun:      dryrun,
+	}
+	if err := k.factory.ReleaseCilium(spec, true); err != nil {
+		return err
+	}
+
+	if dryrun {
+		return nil
+	}
+
+	return k.factory.WaitDaemonSetReady(k.config.Cilium.Namespace, k.config.Cilium.ReleaseName)
+}
+
+// backup writes the kube-proxy daemon set to the backup path, so it can be
+// restored with kubectl apply.
+func (k *KubeProxy) backup(ds *appsv1.DaemonSet, dryrun bool) error {
+	path := k.config.KubeProxyReplacement.BackupPath
+
+	b, err := yaml.Marshal(ds)
+	if err != nil {
+		return err
+	}
+
+	k.log.Infof("backing up %s/%s to %s", ds.Namespace, ds.Name, path)
+	if dryrun {
+		return nil
+	}
+
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// loadBackup reads the kube-proxy daemon set from the backup path, or returns
+// nil if there is no backup.
+func (k *KubeProxy) loadBackup() (*appsv1.DaemonSet, error) {
+	path := k.config.KubeProxyReplacement.BackupPath
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ds := new(appsv1.DaemonSet)
+	if err := yaml.Unmarshal(b, ds); err != nil {
+		return nil, fmt.Errorf("failed to read kube-proxy backup %q: %s", path, err)
+	}
+
+	k.log.Infof("using kube-proxy backup %s", path)
+
+	return ds, nil
+}
+
+// kubeProxy returns the kube-proxy daemon set, stripped of its status and
+// server set fields, or nil if it does not exist.
+func (k *KubeProxy) kubeProxy() (*appsv1.DaemonSet, error) {
+	kpr := k.config.KubeProxyReplacement
+
+	ds, err := k.client.AppsV1().DaemonSets(kpr.Namespace).Get(k.ctx, kpr.DaemonSetName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ds.TypeMeta = metav1.TypeMeta{APIVersion: "apps/v1", Kind: "DaemonSet"}
+	ds.ObjectMeta = metav1.ObjectMeta{
+		Name:        ds.Name,
+		Namespace:   ds.Namespace,
+		Labels:      ds.Labels,
+		Annotations: ds.Annotations,
+	}
+	ds.Status = appsv1.DaemonSetStatus{}
+
+	return ds, nil
+}
+
+// apiServer returns the configured API server endpoint, or the endpoint of
+// the current kube config.
+func (k *KubeProxy) apiServer() (string, int, error) {
+	kpr := k.config.KubeProxyReplacement
+
+	host, port := kpr.K8sServiceHost, kpr.K8sServicePort
+	if host == "" {
+		u := k.client.CoreV1().RESTClient().Get().URL()
+		host = u.Hostname()
+		if port == 0 && u.Port() != "" {
+			p, err := strconv.Atoi(u.Port())
+			if err != nil {
+				return "", 0, err
+			}
+			port = p
+		}
+	}
+
+	if port == 0 {
+		port = 443
+	}
+
+	if host == "" {
+		return "", 0, errors.New("failed to discover the api server host, set kubeProxyReplacement.k8s-service-host")
+	}
+
+	return host, port, nil
+}
+
+// serviceAddresses returns the cluster IP addresses of the kubernetes and
+// kube-dns services, which must be reachable without kube-proxy.
+func (k *KubeProxy) serviceAddresses() ([]string, error) {
+	var addresses []string
+
+	for _, svc := range []struct {
+		namespace, name string
+		port            int32
+	}{
+		{"default", "kubernetes", 443},
+		{"kube-system", "kube-dns", 53},
+	} {
+		s, err := k.client.CoreV1().Services(svc.namespace).Get(k.ctx, svc.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			k.log.Warnf("service %s/%s not found, not checking it", svc.namespace, svc.name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		addresses = append(addresses, net.JoinHostPort(s.Spec.ClusterIP, strconv.Itoa(int(svc.port))))
+	}
+
+	return addresses, nil
+}
+
+// replacementEnabled returns whether a kubeProxyReplacement helm value enables
+// it. The value is a mode string before Cilium 1.14, and may be a boolean
+// from it, either set in a values file or with --set.
+func replacementEnabled(value interface{}) bool {
+	if value == nil {
+		return false
+	}
+
+	switch fmt.Sprint(value) {
+	case "", "disabled", "false":
+		return false
+	default:
+		return true
+	}
+}
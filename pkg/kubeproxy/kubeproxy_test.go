@@ -0,0 +1,29 @@
+package kubeproxy
+
+import "testing"
+
+func TestReplacementEnabled(t *testing.T) {
+	tests := map[string]struct {
+		value interface{}
+
+		expEnabled bool
+	}{
+		"unset":         {value: nil},
+		"empty":         {value: ""},
+		"disabled mode": {value: "disabled"},
+		"false string":  {value: "false"},
+		"false bool":    {value: false},
+		"strict mode":   {value: "strict", expEnabled: true},
+		"partial mode":  {value: "partial", expEnabled: true},
+		"true string":   {value: "true", expEnabled: true},
+		"true bool":     {value: true, expEnabled: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if enabled := replacementEnabled(test.value); enabled != test.expEnabled {
+				t.Errorf("expected %t for %#v, got %t", test.expEnabled, test.value, enabled)
+			}
+		})
+	}
+}
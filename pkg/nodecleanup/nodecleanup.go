@@ -0,0 +1,479 @@
+package nodecleanup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/brnck/cni-migration/pkg"
+	"github.com/brnck/cni-migration/pkg/config"
+	"github.com/brnck/cni-migration/pkg/util"
+)
+
+const (
+	appLabel       = "app"
+	appName        = "aws-node-cleanup"
+	nodeAnnotation = "cni-migration/node"
+
+	// cleanedAnnotation marks nodes which have been cleaned up, with the
+	// time the cleanup started.
+	cleanedAnnotation = "cni-migration/aws-node-cleaned"
+)
+
+// script removes the aws-node artifacts from the node. It is idempotent, and
+// prints a line for everything it removes or did not find.
+const script = `set -eu
+
+remove() {
+	if [ -e "/host$1" ]; then
+		rm -rf "/host$1"
+		echo "removed $1"
+	else
+		echo "not present $1"
+	fi
+}
+
+remove /etc/cni/net.d/10-aws.conflist
+remove /var/run/aws-node
+
+for table in nat mangle filter; do
+	chains=$(iptables-save -t "$table" | sed -n 's/^:\(AWS-\(SNAT\|CONNMARK\)-CHAIN[^ ]*\).*/\1/p')
+
+	# Flush the AWS chains first, so they no longer reference each other.
+	for chain in $chains; do
+		iptables -t "$table" -F "$chain"
+	done
+
+	iptables-save -t "$table" | grep -E -- '^-A .*(-j AWS-(SNAT|CONNMARK)-CHAIN|--comment "?AWS)' | while read -r rule; do
+		eval "iptables -t $table -D ${rule#-A }"
+		echo "removed $table rule: $rule"
+	done
+
+	for chain in $chains; do
+		iptables -t "$table" -X "$chain"
+		echo "removed $table chain $chain"
+	done
+
+	if [ -z "$chains" ]; then
+		echo "not present $table AWS chains"
+	fi
+done
+`
+
+var _ pkg.Step = &NodeCleanup{}
+
+type NodeCleanup struct {
+	ctx    context.Context
+	config *config.Config
+	client *kubernetes.Clientset
+
+	log     *logrus.Entry
+	factory *util.Factory
+}
+
+// result is the outcome of the cleanup of a node.
+type result struct {
+	node      string
+	succeeded bool
+	output    string
+}
+
+func New(ctx context.Context, config *config.Config) pkg.Step {
+	log := config.Log.WithField("step", "11-node-cleanup")
+	return &NodeCleanup{
+		ctx:     ctx,
+		log:     log,
+		config:  config,
+		client:  config.Client,
+		factory: util.New(ctx, log, config),
+	}
+}
+
+// Ready ensures that, if node cleanup is enabled
+// - every node which existed when the cleanup started has been cleaned up
+// - no cleanup jobs are left
+func (n *NodeCleanup) Ready() (bool, error) {
+	if !n.config.NodeCleanup.Enabled {
+		return true, nil
+	}
+
+	nodes, err := n.client.CoreV1().Nodes().List(n.ctx, metav1.ListOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	if len(pendingNodes(nodes.Items)) > 0 {
+		return false, nil
+	}
+
+	jobs, err := n.jobs()
+	if err != nil || len(jobs) > 0 {
+		return false, err
+	}
+
+	n.log.Info("step 11 ready")
+
+	return true, nil
+}
+
+// Run will ensure that, if node cleanup is enabled
+// - AWS VPC CNI daemon set is removed
+// - a privileged job on every pending node removes the aws-node artifacts
+// - the result of every node is reported
+// - the cleanup jobs are removed
+func (n *NodeCleanup) Run(dryrun bool) error {
+	nc := n.config.NodeCleanup
+	if !nc.Enabled {
+		n.log.Info("node cleanup is not enabled, skipping")
+		return nil
+	}
+
+	_, err := n.client.AppsV1().DaemonSets(n.config.AwsVpcCni.Namespace).Get(n.ctx, n.config.AwsVpcCni.DaemonsetName, metav1.GetOptions{})
+	if err == nil {
+		return fmt.Errorf("%s/%s daemon set still exists, it must be deleted before nodes are cleaned up",
+			n.config.AwsVpcCni.Namespace, n.config.AwsVpcCni.DaemonsetName)
+	}
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	// Nodes created after the cleanup started never ran aws-node.
+	started := time.Now()
+
+	nodes, err := n.client.CoreV1().Nodes().List(n.ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	pending := pendingNodes(nodes.Items)
+
+	if len(pending) == 0 {
+		n.log.Info("all nodes are cleaned up")
+		return n.teardown(dryrun)
+	}
+
+	if dryrun {
+		for _, node := range pending {
+			n.log.Infof("would clean up aws-node artifacts on node %s", node)
+		}
+		return nil
+	}
+
+	// Jobs left by a previous run are replaced.
+	if err := n.teardown(false); err != nil {
+		return err
+	}
+
+	for _, node := range pending {
+		if _, err := n.client.BatchV1().Jobs(nc.Namespace).Create(n.ctx, n.job(node), metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create cleanup job for node %s: %s", node, err)
+		}
+	}
+
+	results, waitErr := n.wait(len(pending), started)
+
+	failed := n.report(pending, results)
+
+	if err := n.teardown(false); err != nil {
+		return err
+	}
+
+	if waitErr != nil {
+		return waitErr
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("node cleanup failed on %d nodes: %s", len(failed), strings.Join(failed, ", "))
+	}
+
+	n.log.Infof("cleaned up %d nodes", len(pending))
+
+	return nil
+}
+
+// wait waits for all cleanup jobs to complete or fail, and returns their
+// results by node.
+func (n *NodeCleanup) wait(count int, started time.Time) (map[string]*result, error) {
+	timeout := n.config.NodeCleanup.Timeout
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+
+	results := make(map[string]*result)
+
+	for {
+		jobs, err := n.jobs()
+		if err != nil {
+			return results, err
+		}
+
+		for i := range jobs {
+			job := &jobs[i]
+			node := job.Annotations[nodeAnnotation]
+			if _, ok := results[node]; ok {
+				continue
+			}
+
+			var r *result
+			switch {
+			case job.Status.Succeeded > 0:
+				r = &result{node: node, succeeded: true}
+			case jobFailed(job):
+				r = &result{node: node}
+			default:
+				continue
+			}
+
+			r.output = n.output(job)
+			results[node] = r
+
+			if r.succeeded {
+				if err := n.markCleaned(node, started); err != nil {
+					return results, err
+				}
+			}
+		}
+
+		if len(results) >= count {
+			return results, nil
+		}
+
+		n.log.Debugf("waiting for node cleanup, %d/%d nodes done", len(results), count)
+
+		select {
+		case <-n.ctx.Done():
+			return results, fmt.Errorf("node cleanup failed: %s", n.ctx.Err())
+		case <-deadline:
+			return results, fmt.Errorf("node cleanup not done after %s, %d/%d nodes done", timeout, len(results), count)
+		case <-ticker.C:
+			continue
+		}
+	}
+}
+
+// report logs the result of every node, and returns the nodes whose cleanup
+// failed or did not finish.
+func (n *NodeCleanup) report(nodes []string, results map[string]*result) []string {
+	sort.Strings(nodes)
+
+	var failed []string
+	for _, node := range nodes {
+		log := n.log.WithField("node", node)
+
+		r, ok := results[node]
+		if !ok {
+			log.Error("cleanup did not finish")
+			failed = append(failed, node)
+			continue
+		}
+
+		for _, line := range strings.Split(strings.TrimSpace(r.output), "\n") {
+			if line != "" {
+				log.Info(line)
+			}
+		}
+
+		if r.succeeded {
+			log.Info("cleaned up")
+		} else {
+			log.Error("cleanup failed")
+			failed = append(failed, node)
+		}
+	}
+
+	return failed
+}
+
+// output returns the logs of the pod of a job.
+func (n *NodeCleanup) output(job *batchv1.Job) string {
+	namespace := n.config.NodeCleanup.Namespace
+
+	pods, err := n.client.CoreV1().Pods(namespace).List(n.ctx, metav1.ListOptions{
+		LabelSelector: "job-name=" + job.Name,
+	})
+	if err != nil || len(pods.Items) == 0 {
+		return ""
+	}
+
+	// The last pod holds the result of the last attempt.
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[i].CreationTimestamp.Before(&pods.Items[j].CreationTimestamp)
+	})
+	pod := pods.Items[len(pods.Items)-1]
+
+	logs, err := n.client.CoreV1().Pods(namespace).GetLogs(pod.Name, &corev1.PodLogOptions{}).DoRaw(n.ctx)
+	if err != nil {
+		n.log.Warnf("failed to get cleanup logs of node %s: %s", job.Annotations[nodeAnnotation], err)
+		return ""
+	}
+
+	return string(bytes.TrimSpace(logs))
+}
+
+// pendingNodes returns the nodes which still need cleaning up. Nodes created
+// after the last cleanup started joined once aws-node was removed, so only
+// the nodes which existed then need it.
+func pendingNodes(nodes []corev1.Node) []string {
+	var started time.Time
+	for _, node := range nodes {
+		// Nodes cleaned up by earlier versions are annotated with "true".
+		t, err := time.Parse(time.RFC3339, node.Annotations[cleanedAnnotation])
+		if err == nil && t.After(started) {
+			started = t
+		}
+	}
+
+	var pending []string
+	for _, node := range nodes {
+		if _, ok := node.Annotations[cleanedAnnotation]; ok {
+			continue
+		}
+		if !started.IsZero() && node.CreationTimestamp.Time.After(started) {
+			continue
+		}
+		pending = append(pending, node.Name)
+	}
+
+	return pending
+}
+
+// markCleaned annotates a node as cleaned up by the cleanup started at
+// started.
+func (n *NodeCleanup) markCleaned(node string, started time.Time) error {
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, cleanedAnnotation, started.UTC().Format(time.RFC3339))
+	_, err := n.client.CoreV1().Nodes().Patch(n.ctx, node, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// teardown removes all cleanup jobs and their pods.
+func (n *NodeCleanup) teardown(dryrun bool) error {
+	jobs, err := n.jobs()
+	if err != nil {
+		return err
+	}
+
+	propagation := metav1.DeletePropagationBackground
+	for _, job := range jobs {
+		if dryrun {
+			n.log.Infof("would remove cleanup job %s", job.Name)
+			continue
+		}
+
+		err := n.client.BatchV1().Jobs(job.Namespace).Delete(n.ctx, job.Name, metav1.DeleteOptions{
+			PropagationPolicy: &propagation,
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		n.log.Debugf("removed cleanup job %s", job.Name)
+	}
+
+	return nil
+}
+
+func (n *NodeCleanup) jobs() ([]batchv1.Job, error) {
+	jobs, err := n.client.BatchV1().Jobs(n.config.NodeCleanup.Namespace).List(n.ctx, metav1.ListOptions{
+		LabelSelector: appLabel + "=" + appName,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Jobs being deleted are already torn down.
+	var live []batchv1.Job
+	for _, job := range jobs.Items {
+		if job.DeletionTimestamp == nil {
+			live = append(live, job)
+		}
+	}
+
+	return live, nil
+}
+
+// job returns a privileged job running the cleanup script on node.
+func (n *NodeCleanup) job(node string) *batchv1.Job {
+	var (
+		backoffLimit int32 = 2
+		privileged         = true
+		hostPathType       = corev1.HostPathDirectoryOrCreate
+		lockType           = corev1.HostPathFileOrCreate
+	)
+
+	labels := map[string]string{appLabel: appName}
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: appName + "-",
+			Namespace:    n.config.NodeCleanup.Namespace,
+			Labels:       labels,
+			Annotations:  map[string]string{nodeAnnotation: node},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: corev1.PodSpec{
+					NodeName:      node,
+					HostNetwork:   true,
+					RestartPolicy: corev1.RestartPolicyNever,
+					Tolerations: []corev1.Toleration{
+						{Operator: corev1.TolerationOpExists},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:    "cleanup",
+							Image:   n.config.NodeCleanup.Image,
+							Command: []string{"/bin/sh", "-c", script},
+							SecurityContext: &corev1.SecurityContext{
+								Privileged: &privileged,
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "cni-net-dir", MountPath: "/host/etc/cni/net.d"},
+								{Name: "var-run", MountPath: "/host/var/run"},
+								{Name: "xtables-lock", MountPath: "/run/xtables.lock"},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						hostPathVolume("cni-net-dir", "/etc/cni/net.d", hostPathType),
+						hostPathVolume("var-run", "/var/run", hostPathType),
+						hostPathVolume("xtables-lock", "/run/xtables.lock", lockType),
+					},
+				},
+			},
+		},
+	}
+}
+
+func hostPathVolume(name, path string, pathType corev1.HostPathType) corev1.Volume {
+	return corev1.Volume{
+		Name: name,
+		VolumeSource: corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{Path: path, Type: &pathType},
+		},
+	}
+}
+
+func jobFailed(job *batchv1.Job) bool {
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
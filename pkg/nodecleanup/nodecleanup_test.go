@@ -0,0 +1,70 @@
+package nodecleanup
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPendingNodes(t *testing.T) {
+	started := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	node := func(name string, created time.Time, cleaned string) corev1.Node {
+		n := corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				CreationTimestamp: metav1.NewTime(created),
+			},
+		}
+		if cleaned != "" {
+			n.Annotations = map[string]string{cleanedAnnotation: cleaned}
+		}
+		return n
+	}
+
+	tests := map[string]struct {
+		nodes []corev1.Node
+
+		expPending []string
+	}{
+		"no cleanup yet needs every node": {
+			nodes: []corev1.Node{
+				node("node-a", started.Add(-time.Hour), ""),
+				node("node-b", started.Add(time.Hour), ""),
+			},
+			expPending: []string{"node-a", "node-b"},
+		},
+		"nodes created after the cleanup started are skipped": {
+			nodes: []corev1.Node{
+				node("node-a", started.Add(-time.Hour), started.Format(time.RFC3339)),
+				node("node-b", started.Add(time.Hour), ""),
+			},
+		},
+		"nodes not cleaned up before the cleanup started are pending": {
+			nodes: []corev1.Node{
+				node("node-a", started.Add(-time.Hour), started.Format(time.RFC3339)),
+				node("node-b", started.Add(-time.Hour), ""),
+			},
+			expPending: []string{"node-b"},
+		},
+		"nodes annotated by earlier versions are cleaned up": {
+			nodes: []corev1.Node{
+				node("node-a", started.Add(-time.Hour), "true"),
+				node("node-b", started.Add(time.Hour), ""),
+			},
+			expPending: []string{"node-b"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pending := pendingNodes(test.nodes)
+			if fmt.Sprint(pending) != fmt.Sprint(test.expPending) {
+				t.Errorf("expected pending nodes %v, got %v", test.expPending, pending)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package nodelabeller
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/brnck/cni-migration/pkg/config"
+)
+
+// missingLabelReason is the reason of the events recorded on nodes which have
+// no migration label and match no rule.
+const missingLabelReason = "MissingMigrationLabel"
+
+// Labeller watches nodes, and applies a migration label by the configured
+// node group rules to nodes which have neither. Nodes which match no rule are
+// reported, as neither aws-node nor Cilium is scheduled to them.
+type Labeller struct {
+	ctx    context.Context
+	config *config.Config
+	client *kubernetes.Clientset
+	log    *logrus.Entry
+	dryrun bool
+
+	// reported are the nodes already reported, or logged in dry run. It is
+	// only accessed from the informer's event handlers, which are called one
+	// at a time.
+	reported map[string]bool
+}
+
+func New(ctx context.Context, log *logrus.Entry, config *config.Config, dryrun bool) *Labeller {
+	return &Labeller{
+		ctx:      ctx,
+		config:   config,
+		client:   config.Client,
+		log:      log,
+		dryrun:   dryrun,
+		reported: make(map[string]bool),
+	}
+}
+
+// Run watches nodes until the context is done. All existing nodes are
+// checked first.
+func (l *Labeller) Run() error {
+	factory := informers.NewSharedInformerFactory(l.client, 0)
+	informer := factory.Core().V1().Nodes().Informer()
+
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			l.handle(obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			l.handle(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if node, ok := obj.(*corev1.Node); ok {
+				delete(l.reported, node.Name)
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	factory.Start(l.ctx.Done())
+	defer factory.Shutdown()
+
+	if !cache.WaitForCacheSync(l.ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("failed to sync node informer: %s", l.ctx.Err())
+	}
+
+	l.log.Info("watching for nodes without a migration label")
+
+	<-l.ctx.Done()
+
+	return nil
+}
+
+func (l *Labeller) handle(obj interface{}) {
+	node, ok := obj.(*corev1.Node)
+	if !ok {
+		return
+	}
+
+	if err := l.labelNode(node); err != nil {
+		l.log.WithField("node", node.Name).Errorf("failed to label node: %s", err)
+	}
+}
+
+// labelNode applies the migration label of the first rule matching the node
+// group of a node without a migration label, or reports it if no rule
+// matches.
+func (l *Labeller) labelNode(node *corev1.Node) error {
+	labels := l.config.Labels
+	_, awsVpcCni := node.Labels[labels.AwsVpcCni]
+	_, cilium := node.Labels[labels.Cilium]
+	if awsVpcCni || cilium {
+		delete(l.reported, node.Name)
+		return nil
+	}
+
+	group := node.Labels[l.config.NodeLabeller.NodeGroupLabel]
+	key := l.ruleLabel(group)
+
+	if key == "" {
+		if l.reported[node.Name] {
+			return nil
+		}
+		l.reported[node.Name] = true
+
+		l.log.WithField("node", node.Name).Errorf("node of node group %q has neither the %s nor the %s label and matches no rule, it has no CNI",
+			group, labels.AwsVpcCni, labels.Cilium)
+
+		if l.dryrun {
+			return nil
+		}
+
+		return l.recordEvent(node)
+	}
+
+	if l.dryrun {
+		if !l.reported[node.Name] {
+			l.reported[node.Name] = true
+			l.log.Infof("would label node %s of node group %q with %s", node.Name, group, key)
+		}
+		return nil
+	}
+
+	l.log.Infof("labelling node %s of node group %q with %s", node.Name, group, key)
+
+	patch := fmt.Sprintf(`{"metadata":{"labels":{%q:%q}}}`, key, labels.Value)
+	_, err := l.client.CoreV1().Nodes().Patch(l.ctx, node.Name, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+// ruleLabel returns the migration label key of the first rule matching a
+// node group, or an empty string if none matches.
+func (l *Labeller) ruleLabel(group string) string {
+	for _, rule := range l.config.NodeLabeller.Rules {
+		// Patterns are validated when the config is loaded.
+		if ok, _ := path.Match(rule.NodeGroup, group); !ok {
+			continue
+		}
+
+		switch rule.Label {
+		case "aws-vpc-cni":
+			return l.config.Labels.AwsVpcCni
+		case "cilium":
+			return l.config.Labels.Cilium
+		}
+	}
+
+	return ""
+}
+
+// recordEvent records a warning event on a node which has no migration label,
+// so it is also visible to cluster alerting.
+func (l *Labeller) recordEvent(node *corev1.Node) error {
+	now := metav1.NewTime(time.Now())
+
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: node.Name + ".",
+			Namespace:    metav1.NamespaceDefault,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind:       "Node",
+			APIVersion: "v1",
+			Name:       node.Name,
+			UID:        types.UID(node.Name),
+		},
+		Reason: missingLabelReason,
+		Message: fmt.Sprintf("node has neither the %s nor the %s label and matches no node labeller rule, no CNI is scheduled to it",
+			l.config.Labels.AwsVpcCni, l.config.Labels.Cilium),
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: "cni-migration"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	_, err := l.client.CoreV1().Events(metav1.NamespaceDefault).Create(l.ctx, event, metav1.CreateOptions{})
+	return err
+}
@@ -0,0 +1,53 @@
+package nodelabeller
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/brnck/cni-migration/pkg"
+	"github.com/brnck/cni-migration/pkg/config"
+)
+
+var _ pkg.Step = &labelledStep{}
+
+// labelledStep labels nodes joining while a step runs.
+type labelledStep struct {
+	pkg.Step
+
+	ctx    context.Context
+	config *config.Config
+	log    *logrus.Entry
+}
+
+// Watch wraps step so that nodes joining without a migration label are
+// labelled while it runs. It is meant for the steps which run while every
+// node must have exactly one migration label, from after nodes are labelled
+// in step 2 until aws-node is deleted.
+func Watch(ctx context.Context, config *config.Config, step pkg.Step) pkg.Step {
+	return &labelledStep{
+		Step:   step,
+		ctx:    ctx,
+		config: config,
+		log:    config.Log.WithField("labeller", "nodes"),
+	}
+}
+
+func (s *labelledStep) Run(dryrun bool) error {
+	ctx, cancel := context.WithCancel(s.ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		if err := New(ctx, s.log, s.config, dryrun).Run(); err != nil && ctx.Err() == nil {
+			s.log.Warnf("not labelling new nodes: %s", err)
+		}
+	}()
+
+	err := s.Step.Run(dryrun)
+
+	cancel()
+	<-done
+
+	return err
+}
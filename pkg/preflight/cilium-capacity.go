@@ -0,0 +1,63 @@
+package preflight
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/brnck/cni-migration/pkg/analyse"
+)
+
+// checkCiliumCapacity ensures the free capacity of the Cilium labelled nodes
+// can absorb the workloads drained from the AWS VPC CNI nodes. Capacity is
+// compared in total per resource, so a fragmented cluster may still fail to
+// schedule some pods. The recommended Cilium nodes per node group are logged.
+func (p *Preflight) checkCiliumCapacity() error {
+	if !p.config.Preflight.CiliumCapacity {
+		p.log.Debug("cilium capacity check is not enabled")
+		return nil
+	}
+
+	p.log.Info("checking cilium node capacity...")
+
+	a := analyse.New(p.ctx, p.config)
+
+	plan, err := a.CapacityPlan()
+	if err != nil {
+		return err
+	}
+
+	for _, w := range plan.Warnings {
+		p.log.Warn(w)
+	}
+
+	for _, g := range plan.NodeGroups {
+		p.log.Infof("node group %q %s: %d aws-vpc-cni nodes need %d cilium nodes (limited by %s)",
+			g.NodeGroup, g.InstanceType, g.Nodes, g.RecommendedNodes, g.LimitedBy)
+	}
+
+	free, err := a.CiliumCapacity(plan)
+	if err != nil {
+		return err
+	}
+
+	need := plan.Workloads
+	p.log.Infof("workloads on aws-vpc-cni nodes: %s", need)
+	p.log.Infof("free on cilium nodes: %s", free)
+
+	var short []string
+	if need.MilliCPU > free.MilliCPU {
+		short = append(short, fmt.Sprintf("cpu %dm", need.MilliCPU-free.MilliCPU))
+	}
+	if need.Memory > free.Memory {
+		short = append(short, fmt.Sprintf("memory %dMi", (need.Memory-free.Memory)>>20))
+	}
+	if need.Pods > free.Pods {
+		short = append(short, fmt.Sprintf("pods %d", need.Pods-free.Pods))
+	}
+
+	if len(short) > 0 {
+		return fmt.Errorf("cilium nodes cannot absorb the workloads of aws-vpc-cni nodes, short of %s", strings.Join(short, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/version"
+
+	"github.com/brnck/cni-migration/pkg/aws"
+)
+
+// eksPlatformVersion matches EKS platform versions, e.g. eks.5.
+var eksPlatformVersion = regexp.MustCompile(`^eks\.[0-9]+$`)
+
+// ciliumCompatibility is the supported Kubernetes range and minimum kernel of
+// a Cilium minor release running in ENI mode.
+type ciliumCompatibility struct {
+	minKubernetes string
+	maxKubernetes string
+	minKernel     string
+}
+
+// compatibilityMatrix holds the Kubernetes versions each Cilium minor release
+// is tested against, and the minimum kernel it requires, from the Cilium
+// system requirements and Kubernetes compatibility documentation.
+var compatibilityMatrix = map[string]ciliumCompatibility{
+	"1.10": {minKubernetes: "1.16", maxKubernetes: "1.21", minKernel: "4.9.17"},
+	"1.11": {minKubernetes: "1.16", maxKubernetes: "1.23", minKernel: "4.9.17"},
+	"1.12": {minKubernetes: "1.16", maxKubernetes: "1.24", minKernel: "4.9.17"},
+	"1.13": {minKubernetes: "1.16", maxKubernetes: "1.26", minKernel: "4.19.57"},
+	"1.14": {minKubernetes: "1.16", maxKubernetes: "1.27", minKernel: "4.19.57"},
+	"1.15": {minKubernetes: "1.16", maxKubernetes: "1.29", minKernel: "4.19.57"},
+}
+
+// supportsKubernetes returns whether a Kubernetes minor version is in the
+// supported range.
+func (c ciliumCompatibility) supportsKubernetes(v *version.Version) bool {
+	return !v.LessThan(version.MustParseGeneric(c.minKubernetes)) &&
+		!version.MustParseGeneric(c.maxKubernetes).LessThan(v)
+}
+
+// checkCompatibility compares the API server, EKS platform and node kernel
+// versions against the compatibility matrix of the configured Cilium version. Unsupported
+// combinations fail the check if preflight.strict-compatibility is set, and
+// are only logged otherwise.
+func (p *Preflight) checkCompatibility() error {
+	p.log.Info("checking cilium compatibility with the cluster...")
+
+	problems, err := p.compatibilityProblems()
+	if err != nil {
+		return err
+	}
+
+	if len(problems) == 0 {
+		p.log.Infof("cluster is compatible with cilium %s", p.config.Cilium.Version)
+		return nil
+	}
+
+	for _, problem := range problems {
+		p.log.Warn(problem)
+	}
+
+	if p.config.Preflight.StrictCompatibility {
+		return fmt.Errorf("cluster is not compatible with cilium %s: %s",
+			p.config.Cilium.Version, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+func (p *Preflight) compatibilityProblems() ([]string, error) {
+	ciliumVersion, err := version.ParseGeneric(p.config.Cilium.Version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse cilium version %q: %s", p.config.Cilium.Version, err)
+	}
+
+	minor := fmt.Sprintf("%d.%d", ciliumVersion.Major(), ciliumVersion.Minor())
+	compat, ok := compatibilityMatrix[minor]
+	if !ok {
+		return []string{fmt.Sprintf("cilium %s is not in the compatibility matrix, unable to verify compatibility", minor)}, nil
+	}
+
+	var problems []string
+
+	serverVersion, err := p.client.Discovery().ServerVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	// EKS reports its build in the git version, e.g. v1.24.10-eks-48e63af.
+	p.log.Infof("kubernetes api server version %s", serverVersion.GitVersion)
+	if !strings.Contains(serverVersion.GitVersion, "-eks-") {
+		p.log.Warnf("api server version %s does not look like EKS", serverVersion.GitVersion)
+	}
+
+	kubeVersion, err := version.ParseGeneric(serverVersion.GitVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse api server version %q: %s", serverVersion.GitVersion, err)
+	}
+
+	kubeMinor := version.MustParseGeneric(fmt.Sprintf("%d.%d", kubeVersion.Major(), kubeVersion.Minor()))
+	if !compat.supportsKubernetes(kubeMinor) {
+		problems = append(problems, fmt.Sprintf("kubernetes %s is not supported by cilium %s (supported %s - %s)",
+			kubeMinor, minor, compat.minKubernetes, compat.maxKubernetes))
+	}
+
+	// The EKS platform version is only available from the EKS API.
+	if cluster := p.config.AWS.ClusterName; cluster != "" {
+		eksProblems, err := clusterPlatformProblems(p.ctx, p.config.EKS, cluster, kubeMinor, compat, minor)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, eksProblems...)
+	} else {
+		p.log.Warn("aws.cluster-name is not set, unable to check the eks platform version")
+	}
+
+	nodes, err := p.client.CoreV1().Nodes().List(p.ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	minKernel := version.MustParseGeneric(compat.minKernel)
+	for _, node := range nodes.Items {
+		kernel := node.Status.NodeInfo.KernelVersion
+
+		kernelVersion, err := version.ParseGeneric(kernel)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("node %s: failed to parse kernel version %q", node.Name, kernel))
+			continue
+		}
+
+		if kernelVersion.LessThan(minKernel) {
+			problems = append(problems, fmt.Sprintf("node %s: kernel %s is older than %s required by cilium %s",
+				node.Name, kernel, compat.minKernel, minor))
+		}
+	}
+
+	return problems, nil
+}
+
+// clusterPlatformProblems checks the Kubernetes version of the EKS platform
+// version of a cluster against the compatibility matrix, and that it matches
+// the API server. A cluster being updated changes platform version during the
+// migration, so only active clusters are accepted.
+func clusterPlatformProblems(ctx context.Context, eks aws.EKS, name string, kubeMinor *version.Version, compat ciliumCompatibility, minor string) ([]string, error) {
+	cluster, err := eks.DescribeCluster(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe eks cluster %s: %s", name, err)
+	}
+
+	var problems []string
+
+	if !eksPlatformVersion.MatchString(cluster.PlatformVersion) {
+		problems = append(problems, fmt.Sprintf("eks cluster %s: unknown platform version %q", name, cluster.PlatformVersion))
+	}
+
+	if cluster.Status != "ACTIVE" {
+		problems = append(problems, fmt.Sprintf("eks cluster %s is %s, the platform version may change during the migration", name, cluster.Status))
+	}
+
+	platformMinor, err := version.ParseGeneric(cluster.Version)
+	if err != nil {
+		return append(problems, fmt.Sprintf("eks cluster %s: failed to parse kubernetes version %q", name, cluster.Version)), nil
+	}
+
+	if !compat.supportsKubernetes(platformMinor) {
+		problems = append(problems, fmt.Sprintf("eks platform %s %s is not supported by cilium %s (supported kubernetes %s - %s)",
+			cluster.Version, cluster.PlatformVersion, minor, compat.minKubernetes, compat.maxKubernetes))
+	}
+
+	if platformMinor.Major() != kubeMinor.Major() || platformMinor.Minor() != kubeMinor.Minor() {
+		problems = append(problems, fmt.Sprintf("eks platform %s %s does not match api server version %s",
+			cluster.Version, cluster.PlatformVersion, kubeMinor))
+	}
+
+	return problems, nil
+}
@@ -0,0 +1,60 @@
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/version"
+
+	"github.com/brnck/cni-migration/pkg/aws"
+)
+
+func TestClusterPlatformProblems(t *testing.T) {
+	compat := compatibilityMatrix["1.13"]
+
+	tests := map[string]struct {
+		cluster   aws.Cluster
+		kubeMinor string
+
+		expProblems []string
+	}{
+		"supported platform passes": {
+			cluster:   aws.Cluster{Version: "1.24", PlatformVersion: "eks.5", Status: "ACTIVE"},
+			kubeMinor: "1.24",
+		},
+		"unsupported platform fails": {
+			cluster:   aws.Cluster{Version: "1.27", PlatformVersion: "eks.2", Status: "ACTIVE"},
+			kubeMinor: "1.27",
+			expProblems: []string{
+				"eks platform 1.27 eks.2 is not supported by cilium 1.13 (supported kubernetes 1.16 - 1.26)",
+			},
+		},
+		"updating cluster with unknown platform fails": {
+			cluster:   aws.Cluster{Version: "1.25", PlatformVersion: "1.25.6", Status: "UPDATING"},
+			kubeMinor: "1.24",
+			expProblems: []string{
+				`eks cluster test: unknown platform version "1.25.6"`,
+				"eks cluster test is UPDATING, the platform version may change during the migration",
+				"eks platform 1.25 1.25.6 does not match api server version 1.24",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			eks := &aws.FakeEKS{
+				Clusters: map[string]*aws.Cluster{"test": &test.cluster},
+			}
+
+			problems, err := clusterPlatformProblems(context.TODO(), eks, "test", version.MustParseGeneric(test.kubeMinor), compat, "1.13")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if fmt.Sprintf("%q", problems) != fmt.Sprintf("%q", test.expProblems) {
+				t.Errorf("expected problems %q, got %q", test.expProblems, problems)
+			}
+		})
+	}
+}
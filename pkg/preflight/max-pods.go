@@ -0,0 +1,59 @@
+package preflight
+
+import (
+	"fmt"
+
+	"github.com/brnck/cni-migration/pkg/analyse"
+)
+
+// checkMaxPods ensures the kubelet of Cilium labelled nodes does not admit
+// more pods than Cilium can allocate ENI IPs for on their instance type, which
+// happens when max pods was raised for aws-node, for example for prefix
+// delegation. Such nodes fail the check unless preflight.acknowledge-max-pods
+// is set. Other nodes keep running aws-node until they are decommissioned,
+// so they are only logged, as are nodes admitting fewer pods than their
+// instance type allows.
+func (p *Preflight) checkMaxPods() error {
+	p.log.Info("checking node max pods...")
+
+	mismatches, warnings, err := analyse.New(p.ctx, p.config).MaxPodsMismatches()
+	if err != nil {
+		return err
+	}
+
+	for _, w := range warnings {
+		p.log.Warn(w)
+	}
+
+	var exceeding int
+	for _, m := range mismatches {
+		log := p.log.WithField("node", m.Node)
+
+		if m.Exceeds() && !m.Cilium {
+			log.Infof("kubelet max pods %d exceeds the %d pods cilium can allocate IPs for on %s, the node is not labelled for cilium and keeps running aws-node",
+				m.KubeletMaxPods, m.CiliumAllocatable, m.InstanceType)
+			continue
+		}
+
+		if m.Exceeds() {
+			exceeding++
+			log.Warnf("kubelet max pods %d exceeds the %d pods cilium can allocate IPs for on %s",
+				m.KubeletMaxPods, m.CiliumAllocatable, m.InstanceType)
+			continue
+		}
+
+		log.Infof("kubelet max pods %d is below the %d max pods of %s",
+			m.KubeletMaxPods, m.Recommended, m.InstanceType)
+	}
+
+	if exceeding == 0 {
+		return nil
+	}
+
+	if p.config.Preflight.AcknowledgeMaxPods {
+		p.log.Warnf("%d cilium nodes admit more pods than cilium can allocate IPs for, continuing as acknowledged", exceeding)
+		return nil
+	}
+
+	return fmt.Errorf("%d cilium nodes admit more pods than cilium can allocate IPs for, lower their kubelet max pods or set preflight.acknowledge-max-pods", exceeding)
+}
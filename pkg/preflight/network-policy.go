@@ -0,0 +1,64 @@
+package preflight
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/brnck/cni-migration/pkg/analyse"
+)
+
+// checkNetworkPolicies reports the network policy engines and the policies
+// Cilium enforces differently once it takes over. Policies that cannot be
+// translated to Cilium fail the check unless
+// preflight.acknowledge-network-policies is set.
+func (p *Preflight) checkNetworkPolicies() error {
+	p.log.Info("checking network policy compatibility...")
+
+	r, err := analyse.New(p.ctx, p.config).NetworkPolicies()
+	if err != nil {
+		return err
+	}
+
+	if len(r.Engines) == 0 {
+		p.log.Info("no network policy engine detected")
+	} else {
+		p.log.Infof("network policies are enforced by %s", strings.Join(r.Engines, ", "))
+	}
+
+	for _, engine := range r.Engines {
+		if engine == analyse.PolicyEngineCalico {
+			p.log.Warn("calico must be removed once cilium enforces network policies on all nodes")
+		}
+	}
+
+	p.log.Infof("found %d NetworkPolicies, %d PolicyEndpoints, %d calico GlobalNetworkPolicies, %d calico NetworkPolicies",
+		len(r.NetworkPolicies), r.PolicyEndpoints, r.CalicoGlobalNetworkPolicies, r.CalicoNetworkPolicies)
+
+	var blocking int
+	for _, f := range r.Findings {
+		name := f.Name
+		if f.Namespace != "" {
+			name = f.Namespace + "/" + f.Name
+		}
+		p.log.Warnf("%s %s: %s", f.Kind, name, f.Message)
+
+		if !f.Translatable {
+			blocking++
+		}
+	}
+
+	if n := len(r.NeedsTranslation()); n > 0 {
+		p.log.Warnf("%d NetworkPolicies need CiliumNetworkPolicy equivalents, generate them with `analyse network-policy`", n)
+	}
+
+	if blocking == 0 {
+		return nil
+	}
+
+	if p.config.Preflight.AcknowledgeNetworkPolicies {
+		p.log.Warnf("%d network policy constructs cannot be translated to cilium, continuing as acknowledged", blocking)
+		return nil
+	}
+
+	return fmt.Errorf("%d network policy constructs cannot be translated to cilium, set preflight.acknowledge-network-policies to continue", blocking)
+}
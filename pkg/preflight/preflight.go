@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
 
 	"github.com/brnck/cni-migration/pkg"
 	"github.com/brnck/cni-migration/pkg/config"
@@ -15,6 +16,7 @@ var _ pkg.Step = &Preflight{}
 type Preflight struct {
 	ctx    context.Context
 	config *config.Config
+	client *kubernetes.Clientset
 
 	log     *logrus.Entry
 	factory *util.Factory
@@ -26,7 +28,8 @@ func New(ctx context.Context, config *config.Config) pkg.Step {
 		ctx:     ctx,
 		log:     log,
 		config:  config,
-		factory: util.New(ctx, log, config.Client),
+		client:  config.Client,
+		factory: util.New(ctx, log, config),
 	}
 }
 
@@ -39,10 +42,6 @@ func (p *Preflight) Ready() (bool, error) {
 		return false, err
 	}
 
-	if err := p.factory.WaitDaemonSetReady("knet-stress", "knet-stress"); err != nil {
-		return false, err
-	}
-
 	if err := p.factory.CheckKnetStress(); err != nil {
 		return false, err
 	}
@@ -53,11 +52,41 @@ func (p *Preflight) Ready() (bool, error) {
 }
 
 // Run will ensure that
+// - The cluster is compatible with the Cilium version
+// - No pods use security groups for pods, unless acknowledged
+// - Network policies can be enforced by Cilium, unless acknowledged
+// - The subnets have enough free IPs, if enabled
+// - Node max pods fit the IPs Cilium can allocate, unless acknowledged
+// - Cilium nodes can absorb the AWS VPC CNI workloads, if enabled
 // - Knet-stress is deployed
 // - Knet-stress is healthy
 func (p *Preflight) Run(dryrun bool) error {
 	p.log.Infof("running preflight checks...")
 
+	if err := p.checkCompatibility(); err != nil {
+		return err
+	}
+
+	if err := p.checkSecurityGroupPolicies(); err != nil {
+		return err
+	}
+
+	if err := p.checkNetworkPolicies(); err != nil {
+		return err
+	}
+
+	if err := p.checkSubnetCapacity(); err != nil {
+		return err
+	}
+
+	if err := p.checkMaxPods(); err != nil {
+		return err
+	}
+
+	if err := p.checkCiliumCapacity(); err != nil {
+		return err
+	}
+
 	requiredResources, err := p.factory.Has(p.config.PreflightResources)
 	if err != nil {
 		return err
@@ -66,7 +95,7 @@ func (p *Preflight) Run(dryrun bool) error {
 	if !requiredResources {
 		p.log.Infof("creating knet-stress resources")
 		if !dryrun {
-			if err := p.factory.CreateDaemonSet(p.config.Paths.KnetStress, "knet-stress", "knet-stress"); err != nil {
+			if err := p.factory.CreateKnetStress(); err != nil {
 				return err
 			}
 		}
@@ -0,0 +1,59 @@
+package preflight
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/brnck/cni-migration/pkg/analyse"
+)
+
+// checkSecurityGroupPolicies reports the namespaces and workloads whose pods
+// are selected by a SecurityGroupPolicy, which lose their per pod security
+// groups under Cilium. Affected pods block the migration unless
+// preflight.acknowledge-security-group-policies is set.
+func (p *Preflight) checkSecurityGroupPolicies() error {
+	p.log.Info("checking security groups for pods...")
+
+	policies, err := analyse.New(p.ctx, p.config).SecurityGroupPolicies()
+	if err != nil {
+		return err
+	}
+
+	namespaces := make(map[string]bool)
+	var pods int
+
+	for _, policy := range policies {
+		p.log.Warnf("securitygrouppolicy %s/%s (security groups %s) selects %d pods",
+			policy.Namespace, policy.Name, strings.Join(policy.SecurityGroups, ", "), len(policy.Pods))
+
+		for _, workload := range policy.Workloads {
+			p.log.Warnf("  %s", workload)
+		}
+
+		if len(policy.Pods) > 0 {
+			namespaces[policy.Namespace] = true
+			pods += len(policy.Pods)
+		}
+	}
+
+	if pods == 0 {
+		p.log.Info("no pods use security groups for pods")
+		return nil
+	}
+
+	affected := make([]string, 0, len(namespaces))
+	for ns := range namespaces {
+		affected = append(affected, ns)
+	}
+	sort.Strings(affected)
+
+	if p.config.Preflight.AcknowledgeSecurityGroupPolicies {
+		p.log.Warnf("%d pods in namespaces %s will lose their security groups, continuing as acknowledged",
+			pods, strings.Join(affected, ", "))
+		return nil
+	}
+
+	return fmt.Errorf("%d pods in namespaces %s use security groups for pods, which are not supported by cilium, set preflight.acknowledge-security-group-policies to continue",
+		pods, strings.Join(affected, ", "))
+}
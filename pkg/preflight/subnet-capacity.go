@@ -0,0 +1,256 @@
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/brnck/cni-migration/pkg/analyse"
+	"github.com/brnck/cni-migration/pkg/aws"
+	"github.com/brnck/cni-migration/pkg/config"
+)
+
+const zoneLabel = "topology.kubernetes.io/zone"
+
+// ipPool is the subnet, or the subnets of an availability zone, the pods of a
+// group of nodes draw IPs from.
+type ipPool struct {
+	name    string
+	subnets []string
+	free    int64
+
+	nodes    int
+	pods     int64
+	newNodes int64
+}
+
+// demand is the IPs needed while aws-node and Cilium allocate from the pool
+// side by side: an IP for every running pod, and for each new node its own IP
+// and the IPs Cilium pre-allocates.
+func (p *ipPool) demand(preAllocate int) int64 {
+	return p.pods + p.newNodes*(1+int64(preAllocate))
+}
+
+// checkSubnetCapacity estimates the IPs needed while aws-node and Cilium
+// allocate from the same subnets, and compares them with the free IPs of
+// each subnet. While the old and new nodes coexist, every pod may hold an IP
+// on both, and each new Cilium node needs its own IP and pre-allocates more.
+// Nodes draw IPs from the subnet of their instance, or from the configured or
+// ENIConfig subnets of their availability zone. Insufficient capacity of any
+// subnet or zone fails the check, and demand above subnet-capacity.warn-ratio
+// of its free IPs is logged.
+func (p *Preflight) checkSubnetCapacity() error {
+	sc := p.config.Preflight.SubnetCapacity
+	if !sc.Enabled {
+		p.log.Debug("subnet capacity check is not enabled")
+		return nil
+	}
+
+	p.log.Info("checking subnet ip capacity...")
+
+	nodes, err := p.client.CoreV1().Nodes().List(p.ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	pods, err := p.client.CoreV1().Pods("").List(p.ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	zoneSubnets := sc.SubnetIDs
+	if len(zoneSubnets) == 0 {
+		zoneSubnets, err = analyse.New(p.ctx, p.config).ENIConfigSubnets()
+		if err != nil {
+			return err
+		}
+	}
+
+	pools, warnings, err := subnetPools(p.ctx, p.config.EC2, sc, nodes.Items, pods.Items, zoneSubnets)
+	if err != nil {
+		return err
+	}
+
+	for _, w := range warnings {
+		p.log.Warn(w)
+	}
+
+	for _, pool := range pools {
+		p.log.Infof("%s (%s): estimated ip demand %d: %d pods, %d new nodes with %d pre-allocated ips each, %d free ips",
+			pool.name, strings.Join(pool.subnets, ", "), pool.demand(sc.PreAllocate), pool.pods, pool.newNodes, sc.PreAllocate, pool.free)
+	}
+
+	warnings, err = checkPools(pools, sc)
+	for _, w := range warnings {
+		p.log.Warn(w)
+	}
+
+	return err
+}
+
+// subnetPools groups the nodes, and their running pods, by the pool they draw
+// IPs from. If zoneSubnets is set, nodes draw IPs from those subnets in their
+// availability zone, otherwise from the subnet of their instance. New nodes
+// are spread over the pools as the existing nodes are.
+func subnetPools(ctx context.Context, ec2 aws.EC2, sc *config.SubnetCapacity, nodes []corev1.Node, pods []corev1.Pod, zoneSubnets []string) ([]*ipPool, []string, error) {
+	var warnings []string
+
+	nodePool := make(map[string]string)
+	pools := make(map[string]*ipPool)
+
+	if len(zoneSubnets) > 0 {
+		subnets, err := ec2.DescribeSubnets(ctx, zoneSubnets)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to describe subnets: %s", err)
+		}
+
+		for _, subnet := range subnets {
+			name := "zone " + subnet.AvailabilityZone
+			pool, ok := pools[name]
+			if !ok {
+				pool = &ipPool{name: name}
+				pools[name] = pool
+			}
+			pool.subnets = append(pool.subnets, subnet.ID)
+			pool.free += subnet.AvailableIPs
+		}
+
+		for _, node := range nodes {
+			name := "zone " + node.Labels[zoneLabel]
+			if _, ok := pools[name]; !ok {
+				warnings = append(warnings, fmt.Sprintf("node %s is in zone %q which has none of the subnets %s, not counting it",
+					node.Name, node.Labels[zoneLabel], strings.Join(zoneSubnets, ", ")))
+				continue
+			}
+			nodePool[node.Name] = name
+		}
+	} else {
+		var instances []string
+		nodeInstance := make(map[string]string)
+		for _, node := range nodes {
+			// The provider ID is aws:///<zone>/<instance-id>.
+			id := node.Spec.ProviderID[strings.LastIndex(node.Spec.ProviderID, "/")+1:]
+			if !strings.HasPrefix(id, "i-") {
+				warnings = append(warnings, fmt.Sprintf("node %s is not an EC2 instance, not counting it", node.Name))
+				continue
+			}
+			instances = append(instances, id)
+			nodeInstance[node.Name] = id
+		}
+
+		if len(instances) == 0 {
+			return nil, nil, fmt.Errorf("no subnets found to check capacity, set preflight.subnet-capacity.subnet-ids")
+		}
+
+		instanceSubnets, err := ec2.InstanceSubnets(ctx, instances)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to describe node instances: %s", err)
+		}
+
+		var ids []string
+		for _, node := range nodes {
+			instance, ok := nodeInstance[node.Name]
+			if !ok {
+				continue
+			}
+			subnet := instanceSubnets[instance]
+			if subnet == "" {
+				warnings = append(warnings, fmt.Sprintf("subnet of node %s not found, not counting it", node.Name))
+				continue
+			}
+			nodePool[node.Name] = "subnet " + subnet
+			if !hasString(ids, subnet) {
+				ids = append(ids, subnet)
+			}
+		}
+		sort.Strings(ids)
+
+		subnets, err := ec2.DescribeSubnets(ctx, ids)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to describe subnets: %s", err)
+		}
+
+		for _, subnet := range subnets {
+			name := "subnet " + subnet.ID
+			pools[name] = &ipPool{
+				name:    name,
+				subnets: []string{subnet.ID},
+				free:    subnet.AvailableIPs,
+			}
+		}
+	}
+
+	var counted int
+	for _, name := range nodePool {
+		if pool, ok := pools[name]; ok {
+			pool.nodes++
+			counted++
+		}
+	}
+
+	for _, pod := range pods {
+		if pod.Spec.HostNetwork || pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		if pool, ok := pools[nodePool[pod.Spec.NodeName]]; ok {
+			pool.pods++
+		}
+	}
+
+	var sorted []*ipPool
+	for _, pool := range pools {
+		pool.newNodes = int64(pool.nodes)
+		if sc.NewNodes > 0 && counted > 0 {
+			// Round up, so every pool with nodes gets at least one.
+			pool.newNodes = (int64(sc.NewNodes)*int64(pool.nodes) + int64(counted) - 1) / int64(counted)
+		}
+		sort.Strings(pool.subnets)
+		sorted = append(sorted, pool)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].name < sorted[j].name
+	})
+
+	return sorted, warnings, nil
+}
+
+// checkPools returns an error listing the pools without enough free IPs, and
+// warnings for the pools whose demand exceeds the warn ratio of their free
+// IPs.
+func checkPools(pools []*ipPool, sc *config.SubnetCapacity) ([]string, error) {
+	var (
+		warnings  []string
+		exhausted []string
+	)
+
+	for _, pool := range pools {
+		demand := pool.demand(sc.PreAllocate)
+
+		switch {
+		case demand > pool.free:
+			exhausted = append(exhausted, fmt.Sprintf("%s has %d free ips, %d are needed", pool.name, pool.free, demand))
+		case float64(demand) > sc.WarnRatio*float64(pool.free):
+			warnings = append(warnings, fmt.Sprintf("the migration will use %d of the %d free ips in %s", demand, pool.free, pool.name))
+		}
+	}
+
+	if len(exhausted) > 0 {
+		return warnings, fmt.Errorf("not enough free ips during the migration: %s", strings.Join(exhausted, "; "))
+	}
+
+	return warnings, nil
+}
+
+func hasString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
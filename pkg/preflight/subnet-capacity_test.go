@@ -0,0 +1,139 @@
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/brnck/cni-migration/pkg/aws"
+	"github.com/brnck/cni-migration/pkg/config"
+)
+
+func testNode(name, zone, instance string) corev1.Node {
+	return corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{zoneLabel: zone},
+		},
+		Spec: corev1.NodeSpec{
+			ProviderID: fmt.Sprintf("aws:///%s/%s", zone, instance),
+		},
+	}
+}
+
+func testPods(node string, n int) []corev1.Pod {
+	var pods []corev1.Pod
+	for i := 0; i < n; i++ {
+		pods = append(pods, corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("%s-%d", node, i)},
+			Spec:       corev1.PodSpec{NodeName: node},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		})
+	}
+	return pods
+}
+
+func TestSubnetCapacity(t *testing.T) {
+	ec2 := &aws.FakeEC2{
+		Subnets: map[string]aws.Subnet{
+			"subnet-a": {ID: "subnet-a", AvailabilityZone: "eu-west-1a", CIDR: "10.0.0.0/24", AvailableIPs: 100},
+			"subnet-b": {ID: "subnet-b", AvailabilityZone: "eu-west-1b", CIDR: "10.0.1.0/24", AvailableIPs: 20},
+			"subnet-c": {ID: "subnet-c", AvailabilityZone: "eu-west-1a", CIDR: "10.0.2.0/24", AvailableIPs: 1000},
+		},
+		Instances: map[string]string{
+			"i-a": "subnet-a",
+			"i-b": "subnet-b",
+			"i-c": "subnet-c",
+		},
+	}
+
+	hostNetwork := testPods("node-a", 1)[0]
+	hostNetwork.Name = "host-network"
+	hostNetwork.Spec.HostNetwork = true
+
+	tests := map[string]struct {
+		nodes       []corev1.Node
+		pods        []corev1.Pod
+		newNodes    int
+		zoneSubnets []string
+
+		expPools    map[string]int64
+		expWarnings int
+		expErr      string
+	}{
+		"enough free ips passes": {
+			nodes: []corev1.Node{testNode("node-a", "eu-west-1a", "i-a")},
+			pods:  append(testPods("node-a", 10), hostNetwork),
+			// 10 pods and 1 new node with 9 ips.
+			expPools: map[string]int64{"subnet subnet-a": 19},
+		},
+		"demand above warn ratio warns": {
+			nodes:       []corev1.Node{testNode("node-a", "eu-west-1a", "i-a")},
+			pods:        testPods("node-a", 75),
+			expPools:    map[string]int64{"subnet subnet-a": 84},
+			expWarnings: 1,
+		},
+		"exhausted subnet fails despite free ips in others": {
+			nodes: []corev1.Node{
+				testNode("node-b", "eu-west-1b", "i-b"),
+				testNode("node-c", "eu-west-1a", "i-c"),
+			},
+			pods:     append(testPods("node-b", 15), testPods("node-c", 15)...),
+			expPools: map[string]int64{"subnet subnet-b": 24, "subnet subnet-c": 24},
+			expErr:   "subnet subnet-b has 20 free ips, 24 are needed",
+		},
+		"zone subnets are pooled by zone": {
+			nodes: []corev1.Node{
+				testNode("node-a", "eu-west-1a", "i-a"),
+				testNode("node-c", "eu-west-1a", "i-c"),
+				testNode("node-b", "eu-west-1b", "i-b"),
+			},
+			pods:        append(testPods("node-a", 50), testPods("node-b", 5)...),
+			newNodes:    6,
+			zoneSubnets: []string{"subnet-a", "subnet-b", "subnet-c"},
+			// 4 and 2 new nodes, spread as the existing nodes.
+			expPools: map[string]int64{"zone eu-west-1a": 86, "zone eu-west-1b": 23},
+			expErr:   "zone eu-west-1b has 20 free ips, 23 are needed",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			sc := &config.SubnetCapacity{
+				Enabled:     true,
+				NewNodes:    test.newNodes,
+				PreAllocate: 8,
+				WarnRatio:   0.8,
+			}
+
+			pools, _, err := subnetPools(context.TODO(), ec2, sc, test.nodes, test.pods, test.zoneSubnets)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			demand := make(map[string]int64)
+			for _, pool := range pools {
+				demand[pool.name] = pool.demand(sc.PreAllocate)
+			}
+			if fmt.Sprint(demand) != fmt.Sprint(test.expPools) {
+				t.Errorf("expected pool demand %v, got %v", test.expPools, demand)
+			}
+
+			warnings, err := checkPools(pools, sc)
+			if len(warnings) != test.expWarnings {
+				t.Errorf("expected %d warnings, got %v", test.expWarnings, warnings)
+			}
+
+			switch {
+			case test.expErr == "" && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case test.expErr != "" && (err == nil || !strings.Contains(err.Error(), test.expErr)):
+				t.Errorf("expected error containing %q, got %v", test.expErr, err)
+			}
+		})
+	}
+}
@@ -30,7 +30,7 @@ func New(ctx context.Context, config *config.Config) pkg.Step {
 		ctx:     ctx,
 		config:  config,
 		client:  config.Client,
-		factory: util.New(ctx, log, config.Client),
+		factory: util.New(ctx, log, config),
 	}
 }
 
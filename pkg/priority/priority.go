@@ -30,7 +30,7 @@ func New(ctx context.Context, config *config.Config) pkg.Step {
 		ctx:     ctx,
 		config:  config,
 		client:  config.Client,
-		factory: util.New(ctx, log, config.Client),
+		factory: util.New(ctx, log, config),
 	}
 }
 
@@ -53,6 +53,7 @@ func (p *Priority) Ready() (bool, error) {
 }
 
 // Run ensures that
+// - AWS VPC CNI is not managed by the EKS add-on
 // - AWS VPC CNI has node selector that schedules pod only on AWS VPC nodes
 func (p *Priority) Run(dryrun bool) error {
 	if !dryrun {
@@ -67,6 +68,11 @@ func (p *Priority) Run(dryrun bool) error {
 	}
 
 	if !patched {
+		// The add-on would revert the node selector.
+		if err := p.factory.UnmanageAwsNodeAddon(dryrun); err != nil {
+			return err
+		}
+
 		p.log.Infof("patching aws-node DaemonSet with node selector %s=%s",
 			p.config.Labels.AwsVpcCni, p.config.Labels.Value)
 
@@ -28,7 +28,7 @@ func New(ctx context.Context, config *config.Config) pkg.Step {
 		log:     log,
 		config:  config,
 		client:  config.Client,
-		factory: util.New(ctx, log, config.Client),
+		factory: util.New(ctx, log, config),
 	}
 }
 
@@ -5,11 +5,10 @@ import (
 	"github.com/brnck/cni-migration/pkg"
 	"github.com/brnck/cni-migration/pkg/config"
 	"github.com/brnck/cni-migration/pkg/util"
+	"github.com/brnck/cni-migration/pkg/values"
 	helmclient "github.com/mittwald/go-helm-client"
 	"github.com/sirupsen/logrus"
-	"helm.sh/helm/v3/pkg/repo"
 	"k8s.io/client-go/kubernetes"
-	"os"
 	"time"
 )
 
@@ -33,7 +32,7 @@ func New(ctx context.Context, config *config.Config) pkg.Step {
 		config:     config,
 		client:     config.Client,
 		helmClient: config.HelmClient,
-		factory:    util.New(ctx, log, config.Client),
+		factory:    util.New(ctx, log, config),
 	}
 }
 
@@ -42,7 +41,7 @@ func New(ctx context.Context, config *config.Config) pkg.Step {
 func (u *Update) Ready() (bool, error) {
 	u.log.Info("checking if cilium helm release exists")
 
-	release, err := u.helmClient.GetRelease("cilium")
+	release, err := u.helmClient.GetRelease(u.config.Cilium.ReleaseName)
 	if err != nil || release == nil {
 		return false, err
 	}
@@ -57,50 +56,42 @@ func (u *Update) Ready() (bool, error) {
 
 // Run will ensure that
 // - Cilium is deployed to the cluster
+// - Cilium agents and nodes are healthy
+// - Cilium endpoints and identities have converged
+// - Pods on Cilium nodes are managed by Cilium
 func (u *Update) Run(dryrun bool) error {
 	u.log.Info("updating cilium helm release")
 
-	if err := u.helmClient.AddOrUpdateChartRepo(repo.Entry{
-		Name: "cilium",
-		URL:  u.config.Cilium.RepoPath,
-	}); err != nil {
+	chart, err := u.factory.CiliumChart()
+	if err != nil {
 		return err
 	}
 
-	values, err := os.ReadFile(u.config.CiliumPostMigration)
+	vals, err := values.Build(u.config, values.PostMigration)
 	if err != nil {
 		return err
 	}
 
+	valuesYaml, err := vals.YAML()
+	if err != nil {
+		return err
+	}
+
+	u.log.Infof("effective cilium values:\n%s", valuesYaml)
+
 	spec := &helmclient.ChartSpec{
 		ReleaseName: u.config.Cilium.ReleaseName,
-		ChartName:   u.config.Cilium.ChartName,
+		ChartName:   chart,
 		Namespace:   u.config.Cilium.Namespace,
-		ValuesYaml:  string(values),
+		ValuesYaml:  valuesYaml,
 		Version:     u.config.Cilium.Version,
 		Timeout:     30 * time.Minute,
 		DryRun:      dryrun,
 	}
-	if _, err = u.helmClient.UpgradeChart(u.ctx, spec, nil); err != nil {
+	if err = u.factory.ReleaseCilium(spec, true); err != nil {
 		return err
 	}
 
-	backOff := 5
-
-	for backOff != 0 {
-		release, err := u.helmClient.GetRelease(spec.ReleaseName)
-		if err != nil {
-			return err
-		}
-
-		if !release.Info.Status.IsPending() {
-			break
-		}
-
-		backOff -= 1
-		time.Sleep(1 * time.Second)
-	}
-
 	u.log.Infof("waiting until %s will become ready", u.config.Cilium.ReleaseName)
 	if err = u.factory.WaitDaemonSetReady(u.config.Cilium.Namespace, u.config.Cilium.ReleaseName); err != nil {
 		return err
@@ -108,7 +99,24 @@ func (u *Update) Run(dryrun bool) error {
 	u.log.Infof("%s is ready", u.config.Cilium.ReleaseName)
 
 	if err = u.factory.CheckKnetStress(); err != nil {
-		return nil
+		return err
+	}
+
+	if !dryrun {
+		if err = u.factory.CheckCiliumHealth(); err != nil {
+			return err
+		}
+
+		// Endpoints are re-created and regenerated after the upgrade, so
+		// managed pods are only checked once they converged. Pods without
+		// an endpoint do not hold up convergence.
+		if err = u.factory.WaitCiliumConvergence(); err != nil {
+			return err
+		}
+
+		if err = u.factory.CheckCiliumManagedPods(); err != nil {
+			return err
+		}
 	}
 
 	u.log.Infof("upgraded %s in %s namespace", u.config.Cilium.ReleaseName, u.config.Cilium.Namespace)
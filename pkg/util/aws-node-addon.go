@@ -0,0 +1,115 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// eksManager is the value of the managed-by label, and the field manager,
+	// of resources applied by EKS managed add-ons.
+	eksManager     = "eks"
+	managedByLabel = "app.kubernetes.io/managed-by"
+)
+
+var (
+	addonDeleteTimeout  = 10 * time.Minute
+	addonDeleteInterval = 5 * time.Second
+)
+
+// UnmanageAwsNodeAddon ensures aws-node is not reconciled by the EKS managed
+// add-on, which would otherwise revert changes to the aws-node daemon set or
+// re-create it once deleted. The add-on is deleted with its resources
+// preserved, so aws-node keeps running until it is deleted by the migration.
+func (f *Factory) UnmanageAwsNodeAddon(dryrun bool) error {
+	awsVpcCni := f.config.AwsVpcCni
+
+	ds, err := f.client.AppsV1().DaemonSets(awsVpcCni.Namespace).Get(f.ctx, awsVpcCni.DaemonsetName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !addonManaged(ds) {
+		return nil
+	}
+
+	cluster := f.config.AWS.ClusterName
+	if cluster == "" {
+		return errors.New("aws-node is managed by an EKS add-on, set aws.cluster-name so it can be unmanaged before aws-node is changed")
+	}
+
+	addon, err := f.config.EKS.DescribeAddon(f.ctx, cluster, awsVpcCni.AddonName)
+	if err != nil {
+		return fmt.Errorf("failed to describe eks add-on %s: %s", awsVpcCni.AddonName, err)
+	}
+	if addon == nil {
+		f.log.Debugf("eks add-on %s is not installed, aws-node is no longer managed", awsVpcCni.AddonName)
+		return nil
+	}
+
+	f.log.Infof("aws-node is managed by eks add-on %s %s, removing the add-on and preserving aws-node",
+		addon.Name, addon.Version)
+
+	if dryrun {
+		return nil
+	}
+
+	if err := f.config.EKS.DeleteAddon(f.ctx, cluster, awsVpcCni.AddonName, true); err != nil {
+		return fmt.Errorf("failed to delete eks add-on %s: %s", awsVpcCni.AddonName, err)
+	}
+
+	return f.waitAddonDeleted(cluster, awsVpcCni.AddonName)
+}
+
+func (f *Factory) waitAddonDeleted(cluster, name string) error {
+	deadline := time.After(addonDeleteTimeout)
+	ticker := time.NewTicker(addonDeleteInterval)
+	defer ticker.Stop()
+
+	for {
+		addon, err := f.config.EKS.DescribeAddon(f.ctx, cluster, name)
+		if err != nil {
+			return err
+		}
+
+		if addon == nil {
+			f.log.Infof("eks add-on %s removed, aws-node is no longer managed by eks", name)
+			return nil
+		}
+
+		f.log.Debugf("waiting for eks add-on %s to be removed, status %s", name, addon.Status)
+
+		select {
+		case <-f.ctx.Done():
+			return fmt.Errorf("waiting for eks add-on %s removal: %s", name, f.ctx.Err())
+		case <-deadline:
+			return fmt.Errorf("eks add-on %s not removed after %s, status %s", name, addonDeleteTimeout, addon.Status)
+		case <-ticker.C:
+			continue
+		}
+	}
+}
+
+// addonManaged returns true if the daemon set was applied by an EKS managed
+// add-on.
+func addonManaged(ds *appsv1.DaemonSet) bool {
+	if ds.Labels[managedByLabel] == eksManager {
+		return true
+	}
+
+	for _, field := range ds.ManagedFields {
+		if field.Manager == eksManager {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,152 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/brnck/cni-migration/pkg/aws"
+	"github.com/brnck/cni-migration/pkg/config"
+)
+
+// deletingEKS keeps add-ons in the DELETING status when they are deleted.
+type deletingEKS struct {
+	*aws.FakeEKS
+}
+
+func (d *deletingEKS) DeleteAddon(ctx context.Context, cluster, name string, preserve bool) error {
+	addon := *d.Addons[cluster+"/"+name]
+	if err := d.FakeEKS.DeleteAddon(ctx, cluster, name, preserve); err != nil {
+		return err
+	}
+	addon.Status = "DELETING"
+	d.Addons[cluster+"/"+name] = &addon
+	return nil
+}
+
+// testAwsNodeServer serves the aws-node daemon set with labels from a fake
+// API server.
+func testAwsNodeServer(t *testing.T, labels map[string]string) *kubernetes.Clientset {
+	ds := &appsv1.DaemonSet{
+		TypeMeta: metav1.TypeMeta{Kind: "DaemonSet", APIVersion: "apps/v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "aws-node",
+			Namespace: "kube-system",
+			Labels:    labels,
+		},
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/apis/apps/v1/namespaces/kube-system/daemonsets/aws-node" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ds); err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func TestUnmanageAwsNodeAddon(t *testing.T) {
+	timeout, interval := addonDeleteTimeout, addonDeleteInterval
+	addonDeleteTimeout, addonDeleteInterval = 100*time.Millisecond, 10*time.Millisecond
+	defer func() {
+		addonDeleteTimeout, addonDeleteInterval = timeout, interval
+	}()
+
+	managed := map[string]string{managedByLabel: eksManager}
+	addon := func() map[string]*aws.Addon {
+		return map[string]*aws.Addon{
+			"test/vpc-cni": {Name: "vpc-cni", Version: "v1.12.0-eksbuild.1", Status: "ACTIVE"},
+		}
+	}
+
+	tests := map[string]struct {
+		labels   map[string]string
+		addons   map[string]*aws.Addon
+		deleting bool
+
+		expDeleted map[string]bool
+		expErr     string
+	}{
+		"not managed by the add-on is left unchanged": {
+			addons: addon(),
+		},
+		"missing add-on is not deleted": {
+			labels: managed,
+			addons: map[string]*aws.Addon{},
+		},
+		"managed add-on is deleted preserving aws-node": {
+			labels:     managed,
+			addons:     addon(),
+			expDeleted: map[string]bool{"test/vpc-cni": true},
+		},
+		"add-on not removed in time fails": {
+			labels:     managed,
+			addons:     addon(),
+			deleting:   true,
+			expDeleted: map[string]bool{"test/vpc-cni": true},
+			expErr:     "eks add-on vpc-cni not removed after 100ms, status DELETING",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			fake := &aws.FakeEKS{Addons: test.addons}
+
+			var eks aws.EKS = fake
+			if test.deleting {
+				eks = &deletingEKS{fake}
+			}
+
+			c := &config.Config{
+				AwsVpcCni: &config.AwsVpcCni{
+					Namespace:     "kube-system",
+					DaemonsetName: "aws-node",
+					AddonName:     "vpc-cni",
+				},
+				AWS:    &config.AWS{ClusterName: "test"},
+				EKS:    eks,
+				Client: testAwsNodeServer(t, test.labels),
+			}
+
+			f := New(context.TODO(), logrus.NewEntry(logrus.New()), c)
+
+			err := f.UnmanageAwsNodeAddon(false)
+			switch {
+			case test.expErr == "" && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case test.expErr != "" && (err == nil || !strings.Contains(err.Error(), test.expErr)):
+				t.Errorf("expected error containing %q, got %v", test.expErr, err)
+			}
+
+			if len(fake.Deleted) != len(test.expDeleted) {
+				t.Fatalf("expected deleted add-ons %v, got %v", test.expDeleted, fake.Deleted)
+			}
+			for key, preserve := range test.expDeleted {
+				if got, ok := fake.Deleted[key]; !ok || got != preserve {
+					t.Errorf("expected add-on %s deleted with preserve=%t, got %v", key, preserve, fake.Deleted)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/yaml"
+)
+
+// awsNodeBackupKey is the key of the backup in the backup Secret.
+const awsNodeBackupKey = "aws-node.yaml"
+
+// awsNodeBackupResources are the resources of the kinds in an aws-node
+// backup, in the order they are restored.
+var awsNodeBackupResources = []struct {
+	kind string
+	gvr  schema.GroupVersionResource
+}{
+	{"ServiceAccount", schema.GroupVersionResource{Version: "v1", Resource: "serviceaccounts"}},
+	{"ClusterRole", schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"}},
+	{"ClusterRoleBinding", schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterrolebindings"}},
+	{"ConfigMap", schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}},
+	{"DaemonSet", schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "daemonsets"}},
+}
+
+// BackupAwsNode exports the aws-node DaemonSet, its ConfigMap, ServiceAccount
+// and the cluster roles bound to it, to the local backup file and the backup
+// Secret, so aws-node can be restored after it is deleted.
+func (f *Factory) BackupAwsNode(dryrun bool) error {
+	objects, err := f.awsNodeObjects()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, obj := range objects {
+		b, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return err
+		}
+		buf.WriteString("---\n")
+		buf.Write(b)
+
+		f.log.Infof("backing up %s %s", obj.GetKind(), objectName(obj))
+	}
+
+	awsVpcCni := f.config.AwsVpcCni
+	if dryrun {
+		f.log.Infof("would back up aws-node to %s and secret %s/%s", awsVpcCni.BackupPath, awsVpcCni.Namespace, awsVpcCni.BackupSecret)
+		return nil
+	}
+
+	if err := ioutil.WriteFile(awsVpcCni.BackupPath, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write aws-node backup: %s", err)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      awsVpcCni.BackupSecret,
+			Namespace: awsVpcCni.Namespace,
+		},
+		Data: map[string][]byte{
+			awsNodeBackupKey: buf.Bytes(),
+		},
+	}
+
+	secrets := f.client.CoreV1().Secrets(awsVpcCni.Namespace)
+	_, err = secrets.Create(f.ctx, secret, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		_, err = secrets.Update(f.ctx, secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store aws-node backup in secret %s/%s: %s", awsVpcCni.Namespace, awsVpcCni.BackupSecret, err)
+	}
+
+	f.log.Infof("aws-node backed up to %s and secret %s/%s", awsVpcCni.BackupPath, awsVpcCni.Namespace, awsVpcCni.BackupSecret)
+
+	return nil
+}
+
+// RestoreAwsNode re-creates aws-node from a backup read from path, or from
+// the backup Secret if path is empty. Objects which already exist are left
+// unchanged.
+func (f *Factory) RestoreAwsNode(path string, dryrun bool) error {
+	data, err := f.readAwsNodeBackup(path)
+	if err != nil {
+		return err
+	}
+
+	objects := make(map[string][]*unstructured.Unstructured)
+	for _, doc := range strings.Split(string(data), "\n---\n") {
+		doc = strings.TrimPrefix(strings.TrimSpace(doc), "---")
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+
+		obj := new(unstructured.Unstructured)
+		if err := yaml.Unmarshal([]byte(doc), &obj.Object); err != nil {
+			return fmt.Errorf("failed to decode aws-node backup: %s", err)
+		}
+		objects[obj.GetKind()] = append(objects[obj.GetKind()], obj)
+	}
+
+	for _, r := range awsNodeBackupResources {
+		for _, obj := range objects[r.kind] {
+			name := objectName(obj)
+
+			if dryrun {
+				f.log.Infof("would restore %s %s", r.kind, name)
+				continue
+			}
+
+			var client dynamic.ResourceInterface = f.dynamicClient.Resource(r.gvr)
+			if ns := obj.GetNamespace(); ns != "" {
+				client = f.dynamicClient.Resource(r.gvr).Namespace(ns)
+			}
+
+			_, err := client.Create(f.ctx, obj, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				f.log.Warnf("%s %s already exists, leaving it unchanged", r.kind, name)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to restore %s %s: %s", r.kind, name, err)
+			}
+
+			f.log.Infof("restored %s %s", r.kind, name)
+		}
+	}
+
+	return nil
+}
+
+func (f *Factory) readAwsNodeBackup(path string) ([]byte, error) {
+	if path != "" {
+		f.log.Infof("reading aws-node backup from %s", path)
+		return ioutil.ReadFile(path)
+	}
+
+	awsVpcCni := f.config.AwsVpcCni
+	f.log.Infof("reading aws-node backup from secret %s/%s", awsVpcCni.Namespace, awsVpcCni.BackupSecret)
+
+	secret, err := f.client.CoreV1().Secrets(awsVpcCni.Namespace).Get(f.ctx, awsVpcCni.BackupSecret, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read aws-node backup: %s", err)
+	}
+
+	data, ok := secret.Data[awsNodeBackupKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s has no %s key", awsVpcCni.Namespace, awsVpcCni.BackupSecret, awsNodeBackupKey)
+	}
+
+	return data, nil
+}
+
+// awsNodeObjects returns the aws-node objects to back up, stripped of their
+// status and server set fields.
+func (f *Factory) awsNodeObjects() ([]*unstructured.Unstructured, error) {
+	awsVpcCni := f.config.AwsVpcCni
+
+	ds, err := f.client.AppsV1().DaemonSets(awsVpcCni.Namespace).Get(f.ctx, awsVpcCni.DaemonsetName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []*unstructured.Unstructured
+	add := func(kind, apiVersion string, obj runtime.Object) error {
+		u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, cleanObject(&unstructured.Unstructured{Object: u}, kind, apiVersion))
+		return nil
+	}
+
+	if err := add("DaemonSet", "apps/v1", ds); err != nil {
+		return nil, err
+	}
+
+	cm, err := f.client.CoreV1().ConfigMaps(awsVpcCni.Namespace).Get(f.ctx, awsVpcCni.ConfigMapName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		f.log.Infof("configmap %s/%s not found, not backing it up", awsVpcCni.Namespace, awsVpcCni.ConfigMapName)
+	case err != nil:
+		return nil, err
+	default:
+		if err := add("ConfigMap", "v1", cm); err != nil {
+			return nil, err
+		}
+	}
+
+	saName := ds.Spec.Template.Spec.ServiceAccountName
+	if saName == "" {
+		saName = "default"
+	}
+
+	sa, err := f.client.CoreV1().ServiceAccounts(awsVpcCni.Namespace).Get(f.ctx, saName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// The default service account is not removed with aws-node.
+	if saName != "default" {
+		if err := add("ServiceAccount", "v1", sa); err != nil {
+			return nil, err
+		}
+	}
+
+	rbac := f.client.RbacV1()
+	bindings, err := rbac.ClusterRoleBindings().List(f.ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range bindings.Items {
+		binding := &bindings.Items[i]
+
+		bound := false
+		for _, subject := range binding.Subjects {
+			if subject.Kind == "ServiceAccount" && subject.Name == saName && subject.Namespace == awsVpcCni.Namespace {
+				bound = true
+			}
+		}
+		if !bound {
+			continue
+		}
+
+		if err := add("ClusterRoleBinding", "rbac.authorization.k8s.io/v1", binding); err != nil {
+			return nil, err
+		}
+
+		if binding.RoleRef.Kind != "ClusterRole" {
+			continue
+		}
+
+		role, err := rbac.ClusterRoles().Get(f.ctx, binding.RoleRef.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if err := add("ClusterRole", "rbac.authorization.k8s.io/v1", role); err != nil {
+			return nil, err
+		}
+	}
+
+	return objects, nil
+}
+
+// cleanObject removes the status and server set metadata of an object, so it
+// can be created again.
+func cleanObject(obj *unstructured.Unstructured, kind, apiVersion string) *unstructured.Unstructured {
+	obj.SetKind(kind)
+	obj.SetAPIVersion(apiVersion)
+
+	for _, field := range []string{"resourceVersion", "uid", "creationTimestamp", "generation", "managedFields", "selfLink", "ownerReferences"} {
+		unstructured.RemoveNestedField(obj.Object, "metadata", field)
+	}
+	unstructured.RemoveNestedField(obj.Object, "status")
+
+	return obj
+}
+
+func objectName(obj *unstructured.Unstructured) string {
+	if obj.GetNamespace() != "" {
+		return obj.GetNamespace() + "/" + obj.GetName()
+	}
+	return obj.GetName()
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AwsVpcCniWorkloads returns every AWS VPC CNI labelled node, with the
+// running, non host network pods on it which depend on aws-node. Pods of
+// daemon sets are only included if daemonSets is set, as they are not drained
+// and are removed with the node only if it is scaled away.
+func (f *Factory) AwsVpcCniWorkloads(daemonSets bool) (map[string][]corev1.Pod, error) {
+	nodes, err := f.client.CoreV1().Nodes().List(f.ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", f.config.Labels.AwsVpcCni, f.config.Labels.Value),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	workloads := make(map[string][]corev1.Pod)
+	for _, node := range nodes.Items {
+		pods, err := f.client.CoreV1().Pods("").List(f.ctx, metav1.ListOptions{
+			FieldSelector: "spec.nodeName=" + node.Name,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		workloads[node.Name] = nil
+		for _, pod := range pods.Items {
+			if pod.Spec.HostNetwork || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+				continue
+			}
+			if owner := metav1.GetControllerOf(&pod); !daemonSets && owner != nil && owner.Kind == "DaemonSet" {
+				continue
+			}
+
+			workloads[node.Name] = append(workloads[node.Name], pod)
+		}
+	}
+
+	return workloads, nil
+}
+
+// PodOwner returns the kind and name of the controller of a pod, or the pod
+// itself if it has none.
+func PodOwner(pod *corev1.Pod) string {
+	if owner := metav1.GetControllerOf(pod); owner != nil {
+		return owner.Kind + "/" + owner.Name
+	}
+	return "Pod/" + pod.Name
+}
@@ -0,0 +1,91 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const tcpCheckTimeoutSeconds = 5
+
+// CheckCiliumAgentConnectivity opens a TCP connection to each of the
+// host:port addresses from every ready Cilium agent. The agents run in the
+// host network namespace, so this checks connectivity from every Cilium node.
+func (f *Factory) CheckCiliumAgentConnectivity(addresses ...string) error {
+	agents, err := f.readyCiliumAgents()
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, agent := range agents {
+		for _, address := range addresses {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return fmt.Errorf("invalid address %q: %s", address, err)
+			}
+
+			script := fmt.Sprintf("timeout %d bash -c '</dev/tcp/%s/%s'", tcpCheckTimeoutSeconds, host, port)
+			args := []string{"kubectl", "exec", "--namespace", agent.Namespace, agent.Name,
+				"-c", ciliumAgentContainer, "--", "bash", "-c", script}
+			if err := f.RunCommand(nil, args...); err != nil {
+				failed = append(failed, fmt.Sprintf("node %s: %s", agent.Spec.NodeName, address))
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to connect from cilium agents: %s", strings.Join(failed, ", "))
+	}
+
+	f.log.Infof("%d cilium agents can connect to %s", len(agents), strings.Join(addresses, ", "))
+
+	return nil
+}
+
+// FlushKubeProxyRules removes the iptables rules left behind by kube-proxy
+// on every Cilium node, once kube-proxy has been removed.
+func (f *Factory) FlushKubeProxyRules() error {
+	agents, err := f.readyCiliumAgents()
+	if err != nil {
+		return err
+	}
+
+	for _, agent := range agents {
+		f.log.Infof("flushing kube-proxy iptables rules on node %s", agent.Spec.NodeName)
+
+		args := []string{"kubectl", "exec", "--namespace", agent.Namespace, agent.Name,
+			"-c", ciliumAgentContainer, "--", "bash", "-c", "iptables-save | grep -v KUBE | iptables-restore"}
+		if err := f.RunCommand(nil, args...); err != nil {
+			return fmt.Errorf("failed to flush kube-proxy rules on node %s: %s", agent.Spec.NodeName, err)
+		}
+	}
+
+	return nil
+}
+
+// readyCiliumAgents returns the ready Cilium agent pods.
+func (f *Factory) readyCiliumAgents() ([]*corev1.Pod, error) {
+	pods, err := f.client.CoreV1().Pods(f.config.Cilium.Namespace).List(f.ctx, metav1.ListOptions{
+		LabelSelector: ciliumAgentSelector,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var agents []*corev1.Pod
+	for i := range pods.Items {
+		if podReady(&pods.Items[i]) {
+			agents = append(agents, &pods.Items[i])
+		}
+	}
+
+	if len(agents) == 0 {
+		return nil, fmt.Errorf("no ready cilium agents found in %s", f.config.Cilium.Namespace)
+	}
+
+	return agents, nil
+}
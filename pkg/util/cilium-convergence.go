@@ -0,0 +1,125 @@
+package util
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	defaultCiliumConvergenceTimeout = 10 * time.Minute
+
+	// ciliumIdentityStableChecks is the number of consecutive checks the
+	// CiliumIdentity count must stay the same for before it is considered
+	// stable.
+	ciliumIdentityStableChecks = 3
+)
+
+var (
+	CiliumIdentityGVR = schema.GroupVersionResource{
+		Group:    "cilium.io",
+		Version:  "v2",
+		Resource: "ciliumidentities",
+	}
+)
+
+// WaitCiliumConvergence waits until the CiliumEndpoint of every pod on Cilium
+// labelled nodes is ready, and the number of CiliumIdentities has stopped
+// changing. Pods without an endpoint are not managed by Cilium and never
+// converge, they are left to CheckCiliumManagedPods.
+func (f *Factory) WaitCiliumConvergence() error {
+	f.log.Info("waiting for cilium endpoints and identities to converge...")
+
+	timeout := f.config.Cilium.ConvergenceTimeout
+	if timeout == 0 {
+		timeout = defaultCiliumConvergenceTimeout
+	}
+
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+
+	lastIdentities, stableChecks := -1, 0
+
+	for {
+		pods, ready, err := f.ciliumEndpointsReady()
+		if err != nil {
+			return err
+		}
+
+		identities, err := f.dynamicClient.Resource(CiliumIdentityGVR).List(f.ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+
+		if len(identities.Items) == lastIdentities {
+			stableChecks++
+		} else {
+			lastIdentities, stableChecks = len(identities.Items), 0
+		}
+
+		f.log.Infof("%d/%d endpoints ready, %d identities (stable for %d/%d checks)",
+			ready, pods, lastIdentities, stableChecks, ciliumIdentityStableChecks)
+
+		if ready == pods && stableChecks >= ciliumIdentityStableChecks {
+			f.log.Info("cilium endpoints and identities converged")
+			return nil
+		}
+
+		select {
+		case <-f.ctx.Done():
+			return fmt.Errorf("cilium convergence failed: %s", f.ctx.Err())
+		case <-deadline:
+			return fmt.Errorf("cilium did not converge after %s: %d/%d endpoints ready, identities stable for %d/%d checks",
+				timeout, ready, pods, stableChecks, ciliumIdentityStableChecks)
+		case <-ticker.C:
+			continue
+		}
+	}
+}
+
+// ciliumEndpointsReady returns the number of pods on Cilium labelled nodes
+// which have a CiliumEndpoint, and how many of those endpoints are ready.
+func (f *Factory) ciliumEndpointsReady() (int, int, error) {
+	pods, err := f.ciliumNodePods()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	endpoints, err := f.dynamicClient.Resource(CiliumEndpointGVR).List(f.ctx, metav1.ListOptions{})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	managed, ready := endpointsReady(pods, endpoints.Items)
+
+	return managed, ready, nil
+}
+
+// endpointsReady returns the number of pods with a CiliumEndpoint, and how
+// many of those endpoints are ready.
+func endpointsReady(pods []corev1.Pod, endpoints []unstructured.Unstructured) (int, int) {
+	states := make(map[string]string)
+	for _, cep := range endpoints {
+		state, _, _ := unstructured.NestedString(cep.Object, "status", "state")
+		states[cep.GetNamespace()+"/"+cep.GetName()] = state
+	}
+
+	var managed, ready int
+	for _, pod := range pods {
+		state, ok := states[pod.Namespace+"/"+pod.Name]
+		if !ok {
+			continue
+		}
+		managed++
+		if state == "ready" {
+			ready++
+		}
+	}
+
+	return managed, ready
+}
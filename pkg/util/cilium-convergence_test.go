@@ -0,0 +1,60 @@
+package util
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestEndpointsReady(t *testing.T) {
+	pod := func(name string) corev1.Pod {
+		return corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+	}
+
+	endpoint := func(name, state string) unstructured.Unstructured {
+		cep := unstructured.Unstructured{Object: map[string]interface{}{
+			"status": map[string]interface{}{"state": state},
+		}}
+		cep.SetNamespace("default")
+		cep.SetName(name)
+		return cep
+	}
+
+	tests := map[string]struct {
+		pods      []corev1.Pod
+		endpoints []unstructured.Unstructured
+
+		expManaged int
+		expReady   int
+	}{
+		"all endpoints ready": {
+			pods:       []corev1.Pod{pod("a"), pod("b")},
+			endpoints:  []unstructured.Unstructured{endpoint("a", "ready"), endpoint("b", "ready")},
+			expManaged: 2,
+			expReady:   2,
+		},
+		"endpoint regenerating": {
+			pods:       []corev1.Pod{pod("a"), pod("b")},
+			endpoints:  []unstructured.Unstructured{endpoint("a", "ready"), endpoint("b", "regenerating")},
+			expManaged: 2,
+			expReady:   1,
+		},
+		"pod without an endpoint is not counted": {
+			pods:       []corev1.Pod{pod("a"), pod("unmanaged")},
+			endpoints:  []unstructured.Unstructured{endpoint("a", "ready")},
+			expManaged: 1,
+			expReady:   1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			managed, ready := endpointsReady(test.pods, test.endpoints)
+			if managed != test.expManaged || ready != test.expReady {
+				t.Errorf("expected %d/%d endpoints ready, got %d/%d", test.expReady, test.expManaged, ready, managed)
+			}
+		})
+	}
+}
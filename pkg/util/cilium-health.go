@@ -0,0 +1,228 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+const (
+	ciliumAgentSelector  = "k8s-app=cilium"
+	ciliumAgentContainer = "cilium-agent"
+
+	defaultCiliumHealthTimeout = 5 * time.Minute
+)
+
+var (
+	CiliumNodeGVR = schema.GroupVersionResource{
+		Group:    "cilium.io",
+		Version:  "v2",
+		Resource: "ciliumnodes",
+	}
+)
+
+// ciliumStatus is the subset of `cilium status -o json` which is inspected.
+type ciliumStatus struct {
+	Cilium           *ciliumComponentStatus `json:"cilium"`
+	Kubernetes       *ciliumComponentStatus `json:"kubernetes"`
+	ContainerRuntime *ciliumComponentStatus `json:"container-runtime"`
+	Kvstore          *ciliumComponentStatus `json:"kvstore"`
+	Controllers      []struct {
+		Name   string `json:"name"`
+		Status struct {
+			ConsecutiveFailureCount int    `json:"consecutive-failure-count"`
+			LastFailureMsg          string `json:"last-failure-msg"`
+		} `json:"status"`
+	} `json:"controllers"`
+}
+
+type ciliumComponentStatus struct {
+	State string `json:"state"`
+	Msg   string `json:"msg"`
+}
+
+// CheckCiliumHealth waits for Cilium on every Cilium labelled node to become
+// healthy. This ensures that
+// - the CiliumNode has no ENI IPAM errors and has IPs available
+// - the agent pod on the node is ready
+// - `cilium status` in the agent reports no failures
+func (f *Factory) CheckCiliumHealth() error {
+	f.log.Info("checking cilium health...")
+
+	timeout := f.config.Cilium.HealthTimeout
+	if timeout == 0 {
+		timeout = defaultCiliumHealthTimeout
+	}
+
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+
+	for {
+		problems, err := f.ciliumHealthProblems()
+		if err != nil {
+			return err
+		}
+
+		if len(problems) == 0 {
+			f.log.Info("cilium is healthy")
+			return nil
+		}
+
+		for _, problem := range problems {
+			f.log.Warn(problem)
+		}
+
+		select {
+		case <-f.ctx.Done():
+			return fmt.Errorf("cilium health check failed: %s", f.ctx.Err())
+		case <-deadline:
+			return fmt.Errorf("cilium not healthy after %s: %s", timeout, strings.Join(problems, "; "))
+		case <-ticker.C:
+			continue
+		}
+	}
+}
+
+func (f *Factory) ciliumHealthProblems() ([]string, error) {
+	nodes, err := f.client.CoreV1().Nodes().List(f.ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", f.config.Labels.Cilium, f.config.Labels.Value),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	agents, err := f.client.CoreV1().Pods(f.config.Cilium.Namespace).List(f.ctx, metav1.ListOptions{
+		LabelSelector: ciliumAgentSelector,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	agentByNode := make(map[string]corev1.Pod)
+	for _, pod := range agents.Items {
+		agentByNode[pod.Spec.NodeName] = pod
+	}
+
+	var problems []string
+	for _, node := range nodes.Items {
+		ciliumNode, err := f.dynamicClient.Resource(CiliumNodeGVR).Get(f.ctx, node.Name, metav1.GetOptions{})
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("node %s: failed to get CiliumNode: %s", node.Name, err))
+			continue
+		}
+
+		problems = append(problems, ciliumNodeIPAMProblems(ciliumNode)...)
+
+		agent, ok := agentByNode[node.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("node %s: no cilium agent pod found", node.Name))
+			continue
+		}
+
+		if !podReady(&agent) {
+			problems = append(problems, fmt.Sprintf("node %s: cilium agent %s is not ready", node.Name, agent.Name))
+			continue
+		}
+
+		agentProblems, err := f.ciliumAgentStatusProblems(&agent)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, agentProblems...)
+	}
+
+	return problems, nil
+}
+
+// ciliumNodeIPAMProblems inspects the ENI IPAM status of a CiliumNode.
+func ciliumNodeIPAMProblems(ciliumNode *unstructured.Unstructured) []string {
+	name := ciliumNode.GetName()
+
+	var problems []string
+
+	operatorErr, _, _ := unstructured.NestedString(ciliumNode.Object, "status", "ipam", "operator-status", "error")
+	if operatorErr != "" {
+		problems = append(problems, fmt.Sprintf("node %s: ipam error: %s", name, operatorErr))
+	}
+
+	enis, _, _ := unstructured.NestedMap(ciliumNode.Object, "status", "eni", "enis")
+	if len(enis) == 0 {
+		problems = append(problems, fmt.Sprintf("node %s: no ENIs attached", name))
+	}
+
+	pool, _, _ := unstructured.NestedMap(ciliumNode.Object, "spec", "ipam", "pool")
+	used, _, _ := unstructured.NestedMap(ciliumNode.Object, "status", "ipam", "used")
+	if len(pool)-len(used) <= 0 {
+		problems = append(problems, fmt.Sprintf("node %s: no IPs available (pool %d, used %d)", name, len(pool), len(used)))
+	}
+
+	return problems
+}
+
+// ciliumAgentStatusProblems runs `cilium status` inside the agent and returns
+// failed components and controllers.
+func (f *Factory) ciliumAgentStatusProblems(agent *corev1.Pod) ([]string, error) {
+	cli := ciliumAgentCLI(f.config.Cilium.Version)
+
+	var stdout bytes.Buffer
+	args := []string{"kubectl", "exec", "--namespace", agent.Namespace, agent.Name,
+		"-c", ciliumAgentContainer, "--", cli, "status", "-o", "json"}
+	if err := f.RunCommand(&stdout, args...); err != nil {
+		return []string{fmt.Sprintf("node %s: failed to run %s status in %s: %s", agent.Spec.NodeName, cli, agent.Name, err)}, nil
+	}
+
+	var status ciliumStatus
+	if err := json.Unmarshal(stdout.Bytes(), &status); err != nil {
+		return nil, fmt.Errorf("failed to decode cilium status from %s: %s", agent.Name, err)
+	}
+
+	var problems []string
+	for name, component := range map[string]*ciliumComponentStatus{
+		"cilium":            status.Cilium,
+		"kubernetes":        status.Kubernetes,
+		"container-runtime": status.ContainerRuntime,
+		"kvstore":           status.Kvstore,
+	} {
+		if component != nil && component.State == "Failure" {
+			problems = append(problems, fmt.Sprintf("node %s: %s failure: %s", agent.Spec.NodeName, name, component.Msg))
+		}
+	}
+
+	for _, controller := range status.Controllers {
+		if controller.Status.ConsecutiveFailureCount > 0 {
+			problems = append(problems, fmt.Sprintf("node %s: controller %s failing: %s",
+				agent.Spec.NodeName, controller.Name, controller.Status.LastFailureMsg))
+		}
+	}
+
+	return problems, nil
+}
+
+// ciliumAgentCLI returns the agent debug CLI of a Cilium version, which is
+// named cilium-dbg from Cilium 1.15.
+func ciliumAgentCLI(ciliumVersion string) string {
+	v, err := version.ParseGeneric(ciliumVersion)
+	if err == nil && v.AtLeast(version.MustParseGeneric("1.15")) {
+		return "cilium-dbg"
+	}
+	return "cilium"
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,23 @@
+package util
+
+import "testing"
+
+func TestCiliumAgentCLI(t *testing.T) {
+	tests := map[string]struct {
+		version string
+		expCLI  string
+	}{
+		"before 1.15 uses cilium": {version: "1.14.5", expCLI: "cilium"},
+		"1.15 uses cilium-dbg":    {version: "1.15.0", expCLI: "cilium-dbg"},
+		"later uses cilium-dbg":   {version: "v1.16.1", expCLI: "cilium-dbg"},
+		"unparsable uses cilium":  {version: "", expCLI: "cilium"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if cli := ciliumAgentCLI(test.version); cli != test.expCLI {
+				t.Errorf("expected %s, got %s", test.expCLI, cli)
+			}
+		})
+	}
+}
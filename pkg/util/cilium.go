@@ -0,0 +1,121 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	CiliumEndpointGVR = schema.GroupVersionResource{
+		Group:    "cilium.io",
+		Version:  "v2",
+		Resource: "ciliumendpoints",
+	}
+)
+
+// CheckCiliumManagedPods ensures that every pod running on a Cilium labelled
+// node has a matching CiliumEndpoint. Pods without an endpoint received their
+// networking from another CNI and are restarted if configured to, otherwise an
+// error is returned.
+func (f *Factory) CheckCiliumManagedPods() error {
+	f.log.Info("checking pods on cilium nodes are managed by cilium...")
+
+	unmanaged, err := f.unmanagedCiliumPods()
+	if err != nil {
+		return err
+	}
+
+	if len(unmanaged) == 0 {
+		f.log.Info("all pods on cilium nodes are managed by cilium")
+		return nil
+	}
+
+	var names []string
+	for _, pod := range unmanaged {
+		names = append(names, pod.Namespace+"/"+pod.Name)
+		f.log.Warnf("pod %s/%s on node %s is not managed by cilium", pod.Namespace, pod.Name, pod.Spec.NodeName)
+	}
+
+	if !f.config.Cilium.RestartUnmanagedPods {
+		return fmt.Errorf("found %d pods on cilium nodes not managed by cilium: %s",
+			len(unmanaged), strings.Join(names, ", "))
+	}
+
+	for _, pod := range unmanaged {
+		if metav1.GetControllerOf(&pod) == nil {
+			f.log.Warnf("pod %s/%s has no controller, skipping restart", pod.Namespace, pod.Name)
+			continue
+		}
+
+		f.log.Infof("restarting unmanaged pod %s/%s", pod.Namespace, pod.Name)
+
+		if err := f.client.CoreV1().Pods(pod.Namespace).Delete(f.ctx, pod.Name, metav1.DeleteOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unmanagedCiliumPods returns all running, non host network pods on Cilium
+// labelled nodes which do not have a CiliumEndpoint.
+func (f *Factory) unmanagedCiliumPods() ([]corev1.Pod, error) {
+	pods, err := f.ciliumNodePods()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints, err := f.dynamicClient.Resource(CiliumEndpointGVR).List(f.ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	managed := make(map[string]bool)
+	for _, cep := range endpoints.Items {
+		managed[cep.GetNamespace()+"/"+cep.GetName()] = true
+	}
+
+	var unmanaged []corev1.Pod
+	for _, pod := range pods {
+		if !managed[pod.Namespace+"/"+pod.Name] {
+			unmanaged = append(unmanaged, pod)
+		}
+	}
+
+	return unmanaged, nil
+}
+
+// ciliumNodePods returns all running, non host network pods scheduled to
+// Cilium labelled nodes.
+func (f *Factory) ciliumNodePods() ([]corev1.Pod, error) {
+	nodes, err := f.client.CoreV1().Nodes().List(f.ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", f.config.Labels.Cilium, f.config.Labels.Value),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result []corev1.Pod
+	for _, node := range nodes.Items {
+		pods, err := f.client.CoreV1().Pods("").List(f.ctx, metav1.ListOptions{
+			FieldSelector: "spec.nodeName=" + node.Name,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pod := range pods.Items {
+			if pod.Spec.HostNetwork || pod.Status.Phase != corev1.PodRunning || pod.Status.PodIP == "" {
+				continue
+			}
+
+			result = append(result, pod)
+		}
+	}
+
+	return result, nil
+}
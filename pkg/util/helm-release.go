@@ -0,0 +1,175 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	helmclient "github.com/mittwald/go-helm-client"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+const (
+	// releaseSettleTimeout is how long a release may stay pending after an
+	// install or upgrade returned before it is considered failed.
+	releaseSettleTimeout = 5 * time.Second
+
+	// rollbackSettleTimeout is how long to wait for a rollback to settle.
+	rollbackSettleTimeout = 5 * time.Minute
+)
+
+// ReleaseCilium installs, or upgrades if upgrade is true, the Cilium release
+// described by spec. If the install or upgrade fails, or the release is left
+// failed or pending, it is rolled back to the previous revision, or
+// uninstalled if it was the first install, and the revision history is
+// reported.
+func (f *Factory) ReleaseCilium(spec *helmclient.ChartSpec, upgrade bool) error {
+	helm := f.config.HelmClient
+
+	history, err := f.releaseHistory(spec.ReleaseName)
+	if err != nil {
+		return err
+	}
+
+	if upgrade {
+		_, err = helm.UpgradeChart(f.ctx, spec, nil)
+	} else {
+		_, err = helm.InstallOrUpgradeChart(f.ctx, spec, nil)
+	}
+
+	if spec.DryRun {
+		return err
+	}
+
+	if err == nil {
+		err = f.waitReleaseSettled(spec.ReleaseName, releaseSettleTimeout)
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	f.log.Errorf("%s release failed: %s", spec.ReleaseName, err)
+
+	if rbErr := f.rollbackRelease(spec, history); rbErr != nil {
+		return fmt.Errorf("%s release failed: %s, rollback failed: %s", spec.ReleaseName, err, rbErr)
+	}
+
+	return fmt.Errorf("%s release failed and was rolled back: %s", spec.ReleaseName, err)
+}
+
+// rollbackRelease restores the release to before a failed install or upgrade.
+// previous is the release history from before the install or upgrade.
+func (f *Factory) rollbackRelease(spec *helmclient.ChartSpec, previous []*release.Release) error {
+	helm := f.config.HelmClient
+
+	current, err := helm.GetRelease(spec.ReleaseName)
+	if errors.Is(err, driver.ErrReleaseNotFound) {
+		f.log.Infof("no %s release was created, nothing to roll back", spec.ReleaseName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var last *release.Release
+	if len(previous) > 0 {
+		last = previous[len(previous)-1]
+	}
+
+	if last != nil && current.Version == last.Version && current.Info.Status == last.Info.Status {
+		f.log.Infof("%s release unchanged at revision %d, nothing to roll back", spec.ReleaseName, current.Version)
+		return nil
+	}
+
+	f.logReleaseHistory(spec.ReleaseName)
+
+	if last == nil {
+		f.log.Warnf("uninstalling failed first install of %s", spec.ReleaseName)
+		return helm.UninstallRelease(spec)
+	}
+
+	f.log.Warnf("rolling back %s from revision %d to %d", spec.ReleaseName, current.Version, current.Version-1)
+	if err := helm.RollbackRelease(spec); err != nil {
+		return err
+	}
+
+	if err := f.waitReleaseSettled(spec.ReleaseName, rollbackSettleTimeout); err != nil {
+		return err
+	}
+
+	f.logReleaseHistory(spec.ReleaseName)
+
+	return nil
+}
+
+// waitReleaseSettled waits for the latest revision of a release to leave the
+// pending state, and returns an error if it failed or is still pending after
+// timeout.
+func (f *Factory) waitReleaseSettled(name string, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		rel, err := f.config.HelmClient.GetRelease(name)
+		if err != nil {
+			return err
+		}
+
+		if rel.Info.Status == release.StatusFailed {
+			return fmt.Errorf("release %s revision %d failed: %s", name, rel.Version, rel.Info.Description)
+		}
+
+		if !rel.Info.Status.IsPending() {
+			return nil
+		}
+
+		select {
+		case <-f.ctx.Done():
+			return f.ctx.Err()
+		case <-deadline:
+			return fmt.Errorf("release %s revision %d still %s after %s", name, rel.Version, rel.Info.Status, timeout)
+		case <-ticker.C:
+			continue
+		}
+	}
+}
+
+// releaseHistory returns the revisions of a release, oldest first.
+func (f *Factory) releaseHistory(name string) ([]*release.Release, error) {
+	history, err := f.config.HelmClient.ListReleaseHistory(name, 0)
+	if errors.Is(err, driver.ErrReleaseNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Version < history[j].Version
+	})
+
+	return history, nil
+}
+
+func (f *Factory) logReleaseHistory(name string) {
+	history, err := f.releaseHistory(name)
+	if err != nil {
+		f.log.Warnf("failed to get %s release history: %s", name, err)
+		return
+	}
+
+	f.log.Infof("%s release history:", name)
+	for _, rel := range history {
+		chart := ""
+		if rel.Chart != nil && rel.Chart.Metadata != nil {
+			chart = rel.Chart.Metadata.Name + "-" + rel.Chart.Metadata.Version
+		}
+
+		f.log.Infof("  revision %d: %s %s (%s) %s",
+			rel.Version, rel.Info.Status, chart, rel.Info.LastDeployed.Format(time.RFC3339), rel.Info.Description)
+	}
+}
@@ -0,0 +1,170 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/downloader"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// CiliumChart returns the chart reference to install or upgrade Cilium from,
+// which is either
+// - a local chart directory or archive
+// - a chart in a repository, which is added from cilium.repo-path
+// - a chart in an OCI registry
+// If a checksum or provenance verification is configured, remote charts are
+// pulled to the Helm repository cache and verified first, and the verified
+// archive is returned.
+func (f *Factory) CiliumChart() (string, error) {
+	cilium := f.config.Cilium
+	name := cilium.ChartName
+
+	if _, err := os.Stat(name); err == nil {
+		f.log.Infof("using local cilium chart %s", name)
+
+		if cilium.Verify {
+			if _, err := downloader.VerifyChart(name, f.keyring()); err != nil {
+				return "", fmt.Errorf("failed to verify cilium chart %q: %s", name, err)
+			}
+		}
+
+		if err := verifyChartChecksum(name, cilium.ChartSHA256); err != nil {
+			return "", err
+		}
+
+		return name, nil
+	}
+
+	if !registry.IsOCI(name) && cilium.RepoPath != "" {
+		if err := f.config.HelmClient.AddOrUpdateChartRepo(repo.Entry{
+			Name: chartRepoName(name),
+			URL:  cilium.RepoPath,
+		}); err != nil {
+			return "", err
+		}
+	}
+
+	if !cilium.Verify && cilium.ChartSHA256 == "" {
+		return name, nil
+	}
+
+	path, err := f.pullChart(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to pull cilium chart %q: %s", name, err)
+	}
+
+	if err := verifyChartChecksum(path, cilium.ChartSHA256); err != nil {
+		return "", err
+	}
+
+	f.log.Infof("using verified cilium chart %s", path)
+
+	return path, nil
+}
+
+// pullChart downloads a repository or OCI chart to the Helm repository cache,
+// verifying its provenance if configured.
+func (f *Factory) pullChart(name string) (string, error) {
+	settings := cli.New()
+	settings.RepositoryConfig = f.config.Helm.RepositoryConfig
+	settings.RepositoryCache = f.config.Helm.RepositoryCache
+	if f.config.Helm.RegistryConfig != "" {
+		settings.RegistryConfig = f.config.Helm.RegistryConfig
+	}
+
+	registryClient, err := registry.NewClient(registry.ClientOptCredentialsFile(settings.RegistryConfig))
+	if err != nil {
+		return "", err
+	}
+
+	dl := downloader.ChartDownloader{
+		Out:              os.Stdout,
+		Keyring:          f.keyring(),
+		Getters:          getter.All(settings),
+		RepositoryConfig: settings.RepositoryConfig,
+		RepositoryCache:  settings.RepositoryCache,
+		RegistryClient:   registryClient,
+	}
+
+	if registry.IsOCI(name) {
+		dl.Options = append(dl.Options, getter.WithRegistryClient(registryClient))
+	}
+
+	if f.config.Cilium.Verify {
+		dl.Verify = downloader.VerifyAlways
+	}
+
+	if err := os.MkdirAll(settings.RepositoryCache, 0755); err != nil {
+		return "", err
+	}
+
+	path, _, err := dl.DownloadTo(name, f.config.Cilium.Version, settings.RepositoryCache)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+func (f *Factory) keyring() string {
+	if f.config.Cilium.Keyring != "" {
+		return f.config.Cilium.Keyring
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".gnupg", "pubring.gpg")
+}
+
+// verifyChartChecksum ensures the sha256 checksum of the chart archive at
+// path matches expected. Nothing is checked if expected is empty.
+func verifyChartChecksum(path, expected string) error {
+	if expected == "" {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("cilium chart checksum can only be verified for chart archives, %q is a directory", path)
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+
+	if actual := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("cilium chart %q checksum mismatch: expected %s, got %s", path, expected, actual)
+	}
+
+	return nil
+}
+
+// chartRepoName returns the repository name of a "<repo>/<chart>" reference.
+func chartRepoName(chart string) string {
+	if i := strings.Index(chart, "/"); i > 0 {
+		return chart[:i]
+	}
+	return "cilium"
+}
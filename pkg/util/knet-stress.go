@@ -1,25 +1,123 @@
 package util
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"text/template"
 	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/brnck/cni-migration/pkg/config"
+	"github.com/brnck/cni-migration/resources"
 )
 
+// knetStressDaemonSet is a knet-stress DaemonSet with its node label resolved
+// to a node selector.
+type knetStressDaemonSet struct {
+	Name         string
+	NodeSelector map[string]string
+}
+
+// CreateKnetStress renders and applies the knet-stress manifest, and waits for
+// all knet-stress DaemonSets to become ready.
+func (f *Factory) CreateKnetStress() error {
+	manifest, err := f.RenderKnetStress()
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile("", "knet-stress-*.yaml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(manifest); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	ks := f.config.KnetStress
+	if err := f.createResource(file.Name(), ks.Namespace, ks.Name); err != nil {
+		return err
+	}
+
+	for _, ds := range ks.DaemonSets {
+		if err := f.WaitDaemonSetReady(ks.Namespace, ds.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RenderKnetStress renders the knet-stress manifest from the knetStress
+// config. The embedded template is used unless paths.knet-stress is set.
+func (f *Factory) RenderKnetStress() ([]byte, error) {
+	source := resources.KnetStress
+	if path := f.config.Paths.KnetStress; path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read knet-stress template %q: %s", path, err)
+		}
+		source = string(b)
+	}
+
+	tmpl, err := template.New("knet-stress").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse knet-stress template: %s", err)
+	}
+
+	ks := f.config.KnetStress
+	data := struct {
+		*config.KnetStress
+		DaemonSets []knetStressDaemonSet
+	}{
+		KnetStress: ks,
+	}
+
+	for _, ds := range ks.DaemonSets {
+		data.DaemonSets = append(data.DaemonSets, knetStressDaemonSet{
+			Name:         ds.Name,
+			NodeSelector: f.migrationLabelSelector(ds.NodeLabel),
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render knet-stress template: %s", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
 func (f *Factory) CheckKnetStress() error {
 	f.log.Info("checking knet-stress connectivity...")
 
-	if err := f.WaitDaemonSetReady("knet-stress", "knet-stress"); err != nil {
-		return err
+	ks := f.config.KnetStress
+	for _, ds := range ks.DaemonSets {
+		if err := f.WaitDaemonSetReady(ks.Namespace, ds.Name); err != nil {
+			return err
+		}
 	}
 
 	ticker := time.NewTicker(time.Second * 5)
 
 	for {
-		pods, err := f.client.CoreV1().Pods("knet-stress").List(f.ctx, metav1.ListOptions{
-			LabelSelector: "app=knet-stress",
+		pods, err := f.client.CoreV1().Pods(ks.Namespace).List(f.ctx, metav1.ListOptions{
+			LabelSelector: "app=" + ks.Name,
 		})
 		if err != nil {
 			return err
@@ -27,7 +125,7 @@ func (f *Factory) CheckKnetStress() error {
 
 		ready := true
 		for _, pod := range pods.Items {
-			args := []string{"kubectl", "exec", "--namespace", "knet-stress", pod.Name, "--", "/knet-stress", "status"}
+			args := []string{"kubectl", "exec", "--namespace", ks.Namespace, pod.Name, "--", "/knet-stress", "status"}
 			if err := f.RunCommand(os.Stdout, args...); err != nil {
 				f.log.Error(err.Error())
 				ready = false
@@ -47,3 +145,16 @@ func (f *Factory) CheckKnetStress() error {
 		}
 	}
 }
+
+// migrationLabelSelector returns the node selector for a migration label
+// name, either "aws-vpc-cni" or "cilium".
+func (f *Factory) migrationLabelSelector(nodeLabel string) map[string]string {
+	switch nodeLabel {
+	case "aws-vpc-cni":
+		return map[string]string{f.config.Labels.AwsVpcCni: f.config.Labels.Value}
+	case "cilium":
+		return map[string]string{f.config.Labels.Cilium: f.config.Labels.Value}
+	default:
+		return nil
+	}
+}
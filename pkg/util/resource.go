@@ -7,21 +7,28 @@ import (
 	"os/exec"
 
 	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+
+	"github.com/brnck/cni-migration/pkg/config"
 )
 
 type Factory struct {
-	ctx context.Context
+	ctx    context.Context
+	config *config.Config
 
-	log    *logrus.Entry
-	client *kubernetes.Clientset
+	log           *logrus.Entry
+	client        *kubernetes.Clientset
+	dynamicClient dynamic.Interface
 }
 
-func New(ctx context.Context, log *logrus.Entry, client *kubernetes.Clientset) *Factory {
+func New(ctx context.Context, log *logrus.Entry, config *config.Config) *Factory {
 	return &Factory{
-		ctx:    ctx,
-		log:    log,
-		client: client,
+		ctx:           ctx,
+		config:        config,
+		log:           log,
+		client:        config.Client,
+		dynamicClient: config.DynamicClient,
 	}
 }
 
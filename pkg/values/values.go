@@ -0,0 +1,159 @@
+package values
+
+import (
+	"fmt"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+	helmvalues "helm.sh/helm/v3/pkg/cli/values"
+	"helm.sh/helm/v3/pkg/getter"
+	"k8s.io/apimachinery/pkg/util/version"
+
+	"github.com/brnck/cni-migration/pkg/config"
+)
+
+// Phase is the migration phase Cilium values are built for.
+type Phase string
+
+const (
+	PreMigration  Phase = "pre-migration"
+	PostMigration Phase = "post-migration"
+)
+
+// Build returns the effective Cilium values for phase. Values are merged in
+// the following order, each overriding the previous:
+// - the phase values file from paths
+// - the phase values files from cilium.values, in order
+// - the phase set overrides from cilium.values, in order
+// - the --set overrides given on the command line, in order
+// - the values managed by cni-migration
+func Build(config *config.Config, phase Phase) (chartutil.Values, error) {
+	path, layers := config.Paths.CiliumPreMigration, config.Cilium.Values.PreMigration
+	if phase == PostMigration {
+		path, layers = config.Paths.CiliumPostMigration, config.Cilium.Values.PostMigration
+	}
+
+	opts := &helmvalues.Options{}
+	if path != "" {
+		opts.ValueFiles = append(opts.ValueFiles, path)
+	}
+	if layers != nil {
+		opts.ValueFiles = append(opts.ValueFiles, layers.Files...)
+		opts.Values = append(opts.Values, layers.Set...)
+	}
+	opts.Values = append(opts.Values, config.Cilium.SetOverrides...)
+
+	user, err := opts.MergeValues(getter.Providers{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build %s cilium values: %s", phase, err)
+	}
+
+	vals := chartutil.CoalesceTables(managedValues(config, phase, user), user)
+
+	// tunnel is not accepted by the chart from Cilium 1.15, and is replaced
+	// by the managed routingMode.
+	if ciliumAtLeast(config, "1.14") {
+		delete(vals, "tunnel")
+	}
+
+	// Merging copies the Cilium label back in from a user nodeSelector, so it
+	// is removed from the result.
+	if phase == PostMigration {
+		if nodeSelector, ok := vals["nodeSelector"].(map[string]interface{}); ok {
+			delete(nodeSelector, config.Labels.Cilium)
+		}
+	}
+
+	return vals, nil
+}
+
+// managedValues returns the values which must be set for the migration to
+// work, derived from the migration config:
+// - the agent only runs on Cilium labelled nodes until post-migration
+// - the agent tolerates the Cilium node label taint
+// - ENI IPAM mode with native routing
+func managedValues(config *config.Config, phase Phase, user map[string]interface{}) map[string]interface{} {
+	managed := map[string]interface{}{
+		"ipam": map[string]interface{}{
+			"mode": "eni",
+		},
+		"eni": map[string]interface{}{
+			"enabled": true,
+		},
+	}
+
+	if phase == PreMigration {
+		managed["nodeSelector"] = map[string]interface{}{
+			config.Labels.Cilium: config.Labels.Value,
+		}
+	}
+
+	// Cilium 1.14 replaced tunnel with routingMode, and 1.15 removed it.
+	if ciliumAtLeast(config, "1.14") {
+		managed["routingMode"] = "native"
+	} else {
+		managed["tunnel"] = "disabled"
+	}
+
+	if _, ok := user["egressMasqueradeInterfaces"]; !ok {
+		managed["egressMasqueradeInterfaces"] = "eth*"
+	}
+
+	// The chart tolerates all taints by default, so tolerations only need
+	// managing when they are overridden.
+	if tolerations, ok := user["tolerations"].([]interface{}); ok && !toleratesKey(tolerations, config.Labels.Cilium) {
+		managed["tolerations"] = append(tolerations, map[string]interface{}{
+			"key":      config.Labels.Cilium,
+			"operator": "Exists",
+		})
+	}
+
+	return managed
+}
+
+// toleratesKey returns whether the tolerations tolerate taints with key.
+func toleratesKey(tolerations []interface{}, key string) bool {
+	for _, t := range tolerations {
+		toleration, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if toleration["operator"] != "Exists" {
+			continue
+		}
+
+		if k, _ := toleration["key"].(string); k == "" || k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// KubeProxyReplacement returns the post-migration values with Cilium's
+// kube-proxy replacement enabled, connecting to the API server at host and
+// port directly.
+func KubeProxyReplacement(config *config.Config, host string, port int) (chartutil.Values, error) {
+	vals, err := Build(config, PostMigration)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cilium 1.14 replaced the strict mode with true.
+	mode := "strict"
+	if ciliumAtLeast(config, "1.14") {
+		mode = "true"
+	}
+
+	return chartutil.CoalesceTables(map[string]interface{}{
+		"kubeProxyReplacement": mode,
+		"k8sServiceHost":       host,
+		"k8sServicePort":       port,
+	}, vals), nil
+}
+
+// ciliumAtLeast returns whether the configured Cilium version is at least v.
+func ciliumAtLeast(config *config.Config, v string) bool {
+	current, err := version.ParseGeneric(config.Cilium.Version)
+	return err == nil && current.AtLeast(version.MustParseGeneric(v))
+}
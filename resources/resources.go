@@ -0,0 +1,12 @@
+// Package resources embeds the manifests shipped with cni-migration.
+package resources
+
+import (
+	_ "embed"
+)
+
+// KnetStress is the knet-stress manifest template, rendered from the
+// knetStress config.
+//
+//go:embed knet-stress.yaml
+var KnetStress string